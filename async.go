@@ -0,0 +1,133 @@
+// 封装了对异步访问缓存的操作
+
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+// 异步获取value的结果
+type Future struct {
+	// 完成后关闭
+	done chan struct{}
+
+	item *CacheItem
+	err error
+}
+
+// 缓存表的异步版本，Value立即返回Future
+// 未命中的key交给工作协程加载，同一个key正在加载时共享同一个Future
+// 正在加载的Future保存在缓存表中，多个AsyncTable和同步的Value也共享
+type AsyncTable struct {
+	// 同步的缓存表，Add、Delete等接口直接使用
+	*CacheTable
+
+	// 限制同时加载的工作协程个数
+	workers chan struct{}
+}
+
+// 创建缓存表的异步版本，最多workers个key同时加载，小于等于0时使用1
+func NewAsyncTable(table *CacheTable, workers int) *AsyncTable {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	return &AsyncTable{
+		CacheTable: table,
+		workers: make(chan struct{}, workers),
+	}
+}
+
+// 异步获取value，命中时和同步的Value一样处理，包括提前刷新，返回已经完成的Future
+// 未命中时交给工作协程加载，同一个key正在加载时返回缓存表中正在加载的Future
+// 和Value一样经过OpValue拦截器，After在Future完成后调用
+func (a *AsyncTable) Value(key interface{}, args ...interface{}) *Future {
+	table := a.CacheTable
+
+	table.RLock()
+	interceptors := table.interceptors
+	table.RUnlock()
+
+	if len(interceptors) == 0 {
+		return a.value(key, args...)
+	}
+
+	op := &Op{Kind: OpValue, Key: key}
+	if err := table.runBefore(interceptors, op); err != nil {
+		f := newFuture()
+		f.complete(nil, err)
+		table.runAfter(interceptors, op, nil, err)
+		return f
+	}
+
+	f := a.value(op.Key, args...)
+	go func() {
+		item, err := f.Get()
+		table.runAfter(interceptors, op, item, err)
+	}()
+
+	return f
+}
+
+// Value的实现，不经过拦截器
+func (a *AsyncTable) value(key interface{}, args ...interface{}) *Future {
+	table := a.CacheTable
+
+	if table.Exists(key) {
+		f := newFuture()
+		f.complete(table.value(key, args...))
+		return f
+	}
+
+	f, leader := table.joinLoad(key)
+	if !leader {
+		return f
+	}
+
+	go func() {
+		a.workers <- struct{}{}
+		item, err := table.load(key, args...)
+		<-a.workers
+
+		table.finishLoad(key, f, item, err)
+	}()
+
+	return f
+}
+
+// 等待所有的Future完成，返回的条目和错误与futures一一对应
+func Await(futures ...*Future) ([]*CacheItem, []error) {
+	items := make([]*CacheItem, len(futures))
+	errs := make([]error, len(futures))
+	for i, f := range futures {
+		items[i], errs[i] = f.Get()
+	}
+
+	return items, errs
+}
+
+// 创建Future
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+// 完成Future
+func (f *Future) complete(item *CacheItem, err error) {
+	f.item = item
+	f.err = err
+	close(f.done)
+}
+
+// 返回完成时关闭的通道，可以和其他通道一起select
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// 等待完成，返回条目和错误
+func (f *Future) Get() (*CacheItem, error) {
+	<-f.done
+	return f.item, f.err
+}
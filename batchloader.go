@@ -0,0 +1,330 @@
+// 封装了对批量加载的操作
+
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"time"
+)
+
+// 批量加载函数，一次加载多个不存在的key
+// 返回能加载到的条目，没有返回的key说明不存在
+type BatchLoader func(keys []interface{}) (map[interface{}]*CacheItem, error)
+
+// 一个等待批量加载的批次
+type batch struct {
+	// 批次中的key，不重复
+	keys []interface{}
+	// 去重用
+	seen map[interface{}]bool
+	// 加载完成后关闭
+	done chan struct{}
+
+	// 加载结果，已经加入到表中的条目
+	items map[interface{}]*CacheItem
+	// 批量加载函数返回的错误
+	err error
+}
+
+// 设置批量加载函数，ValuesMany会用它一次加载所有不存在的key
+func (table *CacheTable) SetBatchLoader(f BatchLoader) {
+	table.Lock()
+	defer table.Unlock()
+	table.batchLoader = f
+}
+
+// 设置合并窗口，大于0时，Value在窗口时间内并发未命中的key会合并
+// 成一批，交给批量加载函数一次加载，maxSize大于0时，批次达到
+// maxSize个key会立即加载
+func (table *CacheTable) SetBatchWindow(window time.Duration, maxSize int) {
+	table.Lock()
+	defer table.Unlock()
+	table.batchWindow = window
+	table.batchMaxSize = maxSize
+}
+
+// 获取多个value，命中的条目直接从表中返回，会通过KeepAlive更新访问时间和访问次数
+// 未命中的key通过批量加载函数一次加载，没有设置批量加载函数则逐个调用loadData
+// 匹配到加载函数路由的key不会批量加载，逐个用路由的加载函数加载
+// 返回找到的条目，不存在的key不会出现在结果中
+// 每个key分别经过OpValue拦截器，结果中的key是传入的key，被中止的key不会出现在结果中
+func (table *CacheTable) ValuesMany(keys []interface{}) (map[interface{}]*CacheItem, error) {
+	table.RLock()
+	interceptors := table.interceptors
+	table.RUnlock()
+
+	if len(interceptors) == 0 {
+		return table.valuesMany(keys)
+	}
+
+	ops := make([]*Op, len(keys))
+	errs := make([]error, len(keys))
+	var rewritten []interface{}
+	for i, key := range keys {
+		ops[i] = &Op{Kind: OpValue, Key: key}
+		if errs[i] = table.runBefore(interceptors, ops[i]); errs[i] == nil {
+			rewritten = append(rewritten, ops[i].Key)
+		}
+	}
+
+	found, err := table.valuesMany(rewritten)
+
+	r := make(map[interface{}]*CacheItem, len(keys))
+	for i, op := range ops {
+		if errs[i] != nil {
+			if err == nil {
+				err = errs[i]
+			}
+			table.runAfter(interceptors, op, nil, errs[i])
+			continue
+		}
+
+		item, ok := found[op.Key]
+		if !ok {
+			table.runAfter(interceptors, op, nil, ErrKeyNotFound)
+			continue
+		}
+		r[keys[i]] = item
+		table.runAfter(interceptors, op, item, nil)
+	}
+
+	return r, err
+}
+
+// ValuesMany的实现，不经过拦截器
+func (table *CacheTable) valuesMany(keys []interface{}) (map[interface{}]*CacheItem, error) {
+	r := make(map[interface{}]*CacheItem, len(keys))
+	var candidates []interface{}
+
+	table.RLock()
+
+	now := time.Now()
+	for _, key := range keys {
+		if item, ok := table.items[key]; ok {
+			r[key] = item
+			continue
+		}
+
+		// 负缓存没有过期，不需要加载
+		if expireOn, ok := table.negatives[key]; ok && now.Before(expireOn) {
+			continue
+		}
+
+		candidates = append(candidates, key)
+	}
+	batchLoader := table.batchLoader
+
+	table.RUnlock()
+
+	for _, item := range r {
+		table.hit(item)
+	}
+
+	// 返回第一个加载失败的错误，key不存在不算失败
+	var routedErr error
+	var misses []interface{}
+	for _, key := range candidates {
+		_, routed, err := table.loaderFor(key)
+		if err != nil {
+			if routedErr == nil {
+				routedErr = err
+			}
+			continue
+		}
+		if !routed {
+			misses = append(misses, key)
+			continue
+		}
+
+		// 同一个key正在加载时等待加载的结果
+		item, err := table.loadShared(key)
+		if err == nil {
+			r[key] = item
+		} else if err != ErrKeyNotFoundOrLoadable && routedErr == nil {
+			routedErr = err
+		}
+	}
+
+	if len(misses) == 0 {
+		return r, routedErr
+	}
+
+	if batchLoader == nil {
+		for _, key := range misses {
+			if item, err := table.value(key); err == nil {
+				r[key] = item
+			}
+		}
+
+		return r, routedErr
+	}
+
+	items, err := table.loadBatch(misses, batchLoader)
+	for key, item := range items {
+		r[key] = item
+	}
+
+	if err != nil {
+		return r, err
+	}
+	return r, routedErr
+}
+
+// 通过批量加载函数一次加载keys，同一个key正在加载时等待加载的结果
+// 返回加载到的条目，和第一个加载失败的错误，key不存在不算失败
+func (table *CacheTable) loadBatch(keys []interface{}, batchLoader BatchLoader) (map[interface{}]*CacheItem, error) {
+	b := newBatch()
+	leaders := make(map[interface{}]*Future)
+	followers := make(map[interface{}]*Future)
+	for _, key := range keys {
+		if leaders[key] != nil || followers[key] != nil {
+			continue
+		}
+		if f, leader := table.joinLoad(key); leader {
+			leaders[key] = f
+			b.add(key)
+		} else {
+			followers[key] = f
+		}
+	}
+
+	if len(b.keys) > 0 {
+		table.runBatch(b, batchLoader)
+	}
+
+	r := make(map[interface{}]*CacheItem, len(keys))
+	err := b.err
+	for key, f := range leaders {
+		item, ok := b.items[key]
+		var kerr error
+		if !ok {
+			if kerr = b.err; kerr == nil {
+				kerr = ErrKeyNotFoundOrLoadable
+			}
+		}
+		table.finishLoad(key, f, item, kerr)
+
+		if ok {
+			r[key] = item
+		}
+	}
+	for key, f := range followers {
+		item, kerr := f.Get()
+		if kerr == nil {
+			r[key] = item
+		} else if err == nil && kerr != ErrKeyNotFound && kerr != ErrKeyNotFoundOrLoadable {
+			err = kerr
+		}
+	}
+
+	return r, err
+}
+
+// 通过合并窗口加载一个key
+// 和窗口时间内其他未命中的key一起批量加载
+func (table *CacheTable) batchValue(key interface{}) (*CacheItem, error) {
+	table.Lock()
+
+	b := table.pendingBatch
+	if b == nil {
+		b = newBatch()
+		table.pendingBatch = b
+
+		time.AfterFunc(table.batchWindow, func() {
+			table.dispatchBatch(b)
+		})
+	}
+	b.add(key)
+
+	// 批次满了，立即加载
+	if table.batchMaxSize > 0 && len(b.keys) >= table.batchMaxSize {
+		table.pendingBatch = nil
+		go table.runBatch(b, table.batchLoader)
+	}
+
+	table.Unlock()
+
+	<-b.done
+
+	if item, ok := b.items[key]; ok {
+		return item, nil
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	return nil, ErrKeyNotFoundOrLoadable
+}
+
+// 合并窗口到时，加载还在等待的批次
+func (table *CacheTable) dispatchBatch(b *batch) {
+	table.Lock()
+
+	// 批次已经因为满了被加载
+	if table.pendingBatch != b {
+		table.Unlock()
+		return
+	}
+	table.pendingBatch = nil
+	batchLoader := table.batchLoader
+
+	table.Unlock()
+
+	table.runBatch(b, batchLoader)
+}
+
+// 批量加载一个批次，加载到的条目加入表中
+// 加载成功但没有返回的key加入负缓存
+func (table *CacheTable) runBatch(b *batch, batchLoader BatchLoader) {
+	defer close(b.done)
+
+	start := time.Now()
+	r, err := table.guard(func() (interface{}, error) {
+		return batchLoader(b.keys)
+	})
+	loaded, _ := r.(map[interface{}]*CacheItem)
+	computeTime := time.Since(start)
+
+	b.err = err
+	for _, key := range b.keys {
+		if l, ok := loaded[key]; ok && l != nil {
+			item := NewCacheItem(key, l.lifeSpan, l.data).callbacksFrom(l)
+			item.computeTime = computeTime
+
+			if added, err := table.addLoaded(item); err == nil {
+				b.items[key] = added
+				table.keepStale(key, added)
+			}
+		} else if err == nil {
+			table.forgetStale(key)
+			table.addNegative(key)
+		} else if stale := table.staleItem(key, err); stale != nil {
+			// 批量加载失败，ServeStale时返回旧条目，ValuesMany仍然返回错误
+			b.items[key] = stale
+		}
+	}
+}
+
+// 创建批次
+func newBatch() *batch {
+	return &batch{
+		seen: make(map[interface{}]bool),
+		done: make(chan struct{}),
+		items: make(map[interface{}]*CacheItem),
+	}
+}
+
+// 加入一个key，重复的key只加载一次
+func (b *batch) add(key interface{}) {
+	if b.seen[key] {
+		return
+	}
+	b.seen[key] = true
+	b.keys = append(b.keys, key)
+}
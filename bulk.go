@@ -0,0 +1,178 @@
+// 封装了对批量增删的操作
+
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"time"
+)
+
+// 批量加入条目，不是WriteThrough时只获取一次表的锁，最多触发一次过期检测
+// 每个条目分别经过拦截器，被中止的条目不会加入，返回的两个切片和items一一对应
+// WriteThrough逐个持有key的锁先写入存储再加入表中，和单个key的写入串行执行，写入失败的条目不会加入
+// 全部条目加入表中以后，才按顺序给每个条目触发回调函数和事件，
+// 同一批中相同的key，后面的条目替换前面的，前面的条目以RemovalReplaced触发移除的回调函数
+func (table *CacheTable) AddMany(items []*CacheItem) ([]*CacheItem, []error) {
+	added := make([]*CacheItem, len(items))
+	olds := make([]*CacheItem, len(items))
+	errs := make([]error, len(items))
+	ops := make([]*Op, len(items))
+
+	table.RLock()
+	interceptors := table.interceptors
+	writeThrough := table.store != nil && table.store.opts.Mode == WriteThrough
+	table.RUnlock()
+
+	for i, it := range items {
+		ops[i] = &Op{Kind: OpAdd, Key: it.key, Data: it.data, LifeSpan: it.lifeSpan}
+		if errs[i] = table.runBefore(interceptors, ops[i]); errs[i] != nil {
+			continue
+		}
+		added[i] = NewCacheItem(ops[i].Key, ops[i].LifeSpan, ops[i].Data).callbacksFrom(it)
+	}
+
+	if writeThrough {
+		for i, item := range added {
+			if item == nil {
+				continue
+			}
+
+			unlock := table.lockKey(item.key)
+			if errs[i] = table.storeBefore(item.key, item.data, false); errs[i] == nil {
+				table.Lock()
+				olds[i] = table.install(item)
+				table.Unlock()
+			} else {
+				added[i] = nil
+			}
+			unlock()
+		}
+	} else {
+		table.Lock()
+		for i, item := range added {
+			if item != nil {
+				olds[i] = table.install(item)
+			}
+		}
+		table.Unlock()
+	}
+
+	var smallest time.Duration
+	for _, item := range added {
+		if item != nil && item.lifeSpan > 0 && (smallest == 0 || item.lifeSpan < smallest) {
+			smallest = item.lifeSpan
+		}
+	}
+
+	table.RLock()
+	expDur := table.cleanupInterval
+	addedItem := table.addedItem
+	table.RUnlock()
+
+	for i, item := range added {
+		if item == nil {
+			continue
+		}
+		table.notifyAdded(item, olds[i], addedItem)
+		table.storeAfter(item.key, item.data, false)
+	}
+
+	// 只重新调度一次过期检测
+	if smallest > 0 && (expDur == 0 || smallest < expDur) {
+		table.expirationCheck()
+	}
+
+	for i, op := range ops {
+		table.runAfter(interceptors, op, added[i], errs[i])
+	}
+
+	return added, errs
+}
+
+// 批量删除条目，不是WriteThrough时只获取一次表的锁，返回的两个切片和keys一一对应
+// 每个key分别经过拦截器，不存在的key返回ErrKeyNotFound
+// WriteThrough逐个持有key的锁先从存储删除再从表中删除，删除失败的key不会从缓存中删除
+// 全部条目从表中删除以后，才按顺序给每个条目触发移除的回调函数和事件
+// 和Delete不同，回调函数中条目已经不在表中了
+func (table *CacheTable) DeleteMany(keys []interface{}) ([]*CacheItem, []error) {
+	deleted := make([]*CacheItem, len(keys))
+	errs := make([]error, len(keys))
+	ops := make([]*Op, len(keys))
+
+	table.RLock()
+	interceptors := table.interceptors
+	writeThrough := table.store != nil && table.store.opts.Mode == WriteThrough
+	table.RUnlock()
+
+	for i, key := range keys {
+		ops[i] = &Op{Kind: OpDelete, Key: key}
+		errs[i] = table.runBefore(interceptors, ops[i])
+	}
+
+	// 从表中删除，调用时需要持有表的锁
+	remove := func(i int, key interface{}) {
+		// 删除负缓存，下次访问会重新调用loadData
+		delete(table.negatives, key)
+		delete(table.stale, key)
+
+		r, ok := table.items[key]
+		if !ok {
+			errs[i] = ErrKeyNotFound
+			return
+		}
+
+		table.log("Deleting item with key", key,
+			"created on", r.createdOn, "and hit",
+			r.accessCount, "times from table", table.name)
+		delete(table.items, key)
+		deleted[i] = r
+	}
+
+	if writeThrough {
+		for i, op := range ops {
+			if errs[i] != nil {
+				continue
+			}
+
+			unlock := table.lockKey(op.Key)
+			if errs[i] = table.storeBefore(op.Key, nil, true); errs[i] == nil {
+				table.Lock()
+				remove(i, op.Key)
+				table.compactScanIndex()
+				table.Unlock()
+			}
+			unlock()
+		}
+	} else {
+		table.Lock()
+		for i, op := range ops {
+			if errs[i] == nil {
+				remove(i, op.Key)
+			}
+		}
+		table.compactScanIndex()
+		table.Unlock()
+	}
+
+	for i, op := range ops {
+		if deleted[i] != nil {
+			table.notifyRemoval(deleted[i], RemovalExplicit)
+		}
+		// 和Delete一样，不管缓存中是否存在都会从存储中删除
+		if errs[i] == nil || errs[i] == ErrKeyNotFound {
+			table.storeAfter(op.Key, nil, true)
+		}
+	}
+
+	for i, op := range ops {
+		table.runAfter(interceptors, op, deleted[i], errs[i])
+	}
+
+	return deleted, errs
+}
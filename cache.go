@@ -12,6 +12,7 @@ package cache2go
 
 import (
 	"sync"
+	"time"
 )
 
 var (
@@ -23,24 +24,39 @@ var (
 
 // 创建缓存
 func Cache(table string) *CacheTable {
+	t, _ := cacheTable(table)
+	return t
+}
+
+// 获取缓存表，不存在就创建
+// 第二个返回值说明是否是新创建的
+func cacheTable(table string) (*CacheTable, bool) {
 	mutex.RLock()
 	t, ok := cache[table]
 	mutex.RUnlock()
 
-	if !ok {
-		mutex.Lock()
+	if ok {
+		return t, false
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
 
-		// 还需要再次检测一次
-		t, ok = cache[table]
-		if !ok {
-			t = &CacheTable{
-				name: table,
-				items: make(map[interface{}]*CacheItem),
-			}
-		}
+	// 还需要再次检测一次
+	t, ok = cache[table]
+	if ok {
+		return t, false
+	}
 
-		mutex.Unlock()
+	t = &CacheTable{
+		name: table,
+		items: make(map[interface{}]*CacheItem),
+		negatives: make(map[interface{}]time.Time),
+		refreshing: make(map[interface{}]bool),
+		keyLocks: make(map[interface{}]*keyLock),
+		inflight: make(map[interface{}]*Future),
 	}
+	cache[table] = t
 
-	return t
+	return t, true
 }
\ No newline at end of file
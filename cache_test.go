@@ -11,8 +11,10 @@ package cache2go
 
 import (
 	"bytes"
+	"errors"
 	"log"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -25,9 +27,30 @@ var (
 	v = "testvalue"
 )
 
+// 获取测试用的缓存表，测试结束后清空并从cache中删除
+// 保证每个测试使用新的缓存表，go test -count可以重复运行
+func testCache(t *testing.T, name string) *CacheTable {
+	t.Cleanup(func() {
+		dropTestCache(name)
+	})
+	return Cache(name)
+}
+
+// 清空缓存表并从cache中删除
+func dropTestCache(name string) {
+	mutex.Lock()
+	table, ok := cache[name]
+	delete(cache, name)
+	mutex.Unlock()
+
+	if ok {
+		table.Flush()
+	}
+}
+
 // 表增加测试
 func TestCache(t *testing.T) {
-	table := Cache("testCache")
+	table := testCache(t, "testCache")
 	// 永久保活
 	table.Add(k + "_1", 0 * time.Second, v)
 	// 保活1秒
@@ -64,7 +87,7 @@ func TestCache(t *testing.T) {
 
 // 保活时间检测
 func TestCacheExpire(t *testing.T) {
-	table := Cache("testCache")
+	table := testCache(t, "testCache")
 
 	table.Add(k + "_1", 100 * time.Millisecond, v + "_1")
 	table.Add(k + "_2", 125 * time.Millisecond, v + "_2")
@@ -94,7 +117,7 @@ func TestCacheExpire(t *testing.T) {
 
 // 条目是否存在测试
 func TestExists(t *testing.T) {
-	table := Cache("testExists")
+	table := testCache(t, "testExists")
 	table.Add(k, 0, v)
 	if !table.Exists(k) {
 		t.Error("Error verifying existing data in cache")
@@ -103,7 +126,7 @@ func TestExists(t *testing.T) {
 
 // 表中不存在条目就添加测试
 func TestNotFoundAdd(t *testing.T) {
-	table := Cache("testNotFoundAdd")
+	table := testCache(t, "testNotFoundAdd")
 
 	if !table.NotFoundAdd(k, 0, v) {
 		t.Error("Error verifying NotFoundAdd, data not in cache")
@@ -116,7 +139,7 @@ func TestNotFoundAdd(t *testing.T) {
 
 // 表中不存在条目就添加的并发测试
 func TestNotFoundAddConcurrency(t *testing.T) {
-	table := Cache("testNotFoundAdd")
+	table := testCache(t, "testNotFoundAdd")
 
 	// 倒计时计数器
 	var finish sync.WaitGroup
@@ -174,7 +197,7 @@ func TestNotFoundAddConcurrency(t *testing.T) {
 
 // 检测条目的保活相关
 func TestCacheKeepAlive(t *testing.T) {
-	table := Cache("testKeepAlive")
+	table := testCache(t, "testKeepAlive")
 	p := table.Add(k, 100 * time.Millisecond, v)
 
 	time.Sleep(50 * time.Millisecond)
@@ -193,7 +216,7 @@ func TestCacheKeepAlive(t *testing.T) {
 
 // 测试删除条目接口
 func TestDelete(t *testing.T) {
-	table := Cache("testDelete")
+	table := testCache(t, "testDelete")
 	table.Add(k, 0, v)
 
 	p, err := table.Value(k)
@@ -216,7 +239,7 @@ func TestDelete(t *testing.T) {
 
 // 测试flush接口
 func TestFlush(t *testing.T) {
-	table := Cache("testFlush")
+	table := testCache(t, "testFlush")
 	table.Add(k, 10 * time.Second, v)
 	table.Flush()
 
@@ -233,7 +256,7 @@ func TestFlush(t *testing.T) {
 
 // 测试Count接口
 func TestCount(t *testing.T) {
-	table := Cache("testCount")
+	table := testCache(t, "testCount")
 	count := 100000
 	for i := 0; i < count; i++ {
 		key := k + strconv.Itoa(i)
@@ -255,7 +278,7 @@ func TestCount(t *testing.T) {
 
 // 测试DataLoader接口
 func TestDataLoader(t *testing.T) {
-	table := Cache("testDataLoader")
+	table := testCache(t, "testDataLoader")
 	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
 		var item *CacheItem
 		if key.(string) != "nil" {
@@ -285,7 +308,7 @@ func TestDataLoader(t *testing.T) {
 // 测试MostAccessed接口
 func TestAccessCount(t *testing.T) {
 	count := 100
-	table := Cache("testAccessCount")
+	table := testCache(t, "testAccessCount")
 	for i := 0; i < count; i++ {
 		table.Add(i, 10 * time.Second, v)
 	}
@@ -321,7 +344,7 @@ func TestCallbacks(t *testing.T) {
 	expired := false
 	calledExpired := false
 
-	table := Cache("testCallbacks")
+	table := testCache(t, "testCallbacks")
 	
 	// 设置添加缓存条目时触发的回调函数，会删除以前的回调函数
 	table.SetAddedItemCallback(func(item *CacheItem) {
@@ -390,7 +413,7 @@ func TestCallbackQueue(t *testing.T) {
 	expired := false
 	calledExpired := false
 
-	table := Cache("testCallbacks")
+	table := testCache(t, "testCallbacks")
 
 	// 添加缓存条目时触发的回调函数
 	table.AddAddedItemCallback(func(item *CacheItem) {
@@ -494,7 +517,7 @@ func TestLogger(t *testing.T) {
 	out := new(bytes.Buffer)
 	l := log.New(out, "cache2go ", log.Ldate|log.Ltime)
 
-	table := Cache("testLogger")
+	table := testCache(t, "testLogger")
 	table.SetLogger(l)
 
 	table.Add(k, 0, v)
@@ -505,3 +528,1850 @@ func TestLogger(t *testing.T) {
 		t.Error("Logger is empty")
 	}
 }
+
+// 测试负缓存
+func TestNegativeCache(t *testing.T) {
+	table := testCache(t, "testNegativeCache")
+	table.SetNegativeLifeSpan(100 * time.Millisecond)
+
+	var loads int32
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		atomic.AddInt32(&loads, 1)
+		return nil
+	})
+
+	_, err := table.Value(k)
+	if err != ErrKeyNotFoundOrLoadable {
+		t.Error("Error loading missing key", err)
+	}
+
+	// 负缓存命中，不会调用loadData
+	_, err = table.Value(k)
+	if err != ErrKeyNotFound || atomic.LoadInt32(&loads) != 1 {
+		t.Error("Error serving negative item", err)
+	}
+	if table.Count() != 0 || table.Exists(k) || table.NegativeCount() != 1 {
+		t.Error("Negative item should not be counted")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if table.NegativeCount() != 0 {
+		t.Error("Error expiring negative item")
+	}
+	table.Value(k)
+	if atomic.LoadInt32(&loads) != 2 {
+		t.Error("Expired negative item should call data loader again")
+	}
+
+	// 加入条目覆盖负缓存
+	table.Add(k, 0, v)
+	p, err := table.Value(k)
+	if err != nil || p.Data().(string) != v || table.NegativeCount() != 0 {
+		t.Error("Error replacing negative item", err)
+	}
+}
+
+// 测试提前刷新
+func TestRefreshAhead(t *testing.T) {
+	table := testCache(t, "testRefreshAhead")
+	table.SetRefreshThreshold(0.5)
+
+	var loads int32
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		n := atomic.AddInt32(&loads, 1)
+		return NewCacheItem(key, 200*time.Millisecond, n)
+	})
+
+	p, err := table.Value(k)
+	if err != nil || p.Data().(int32) != 1 {
+		t.Error("Error loading data", err)
+	}
+
+	time.Sleep(120 * time.Millisecond)
+
+	// 超过阈值，继续返回当前条目，同时异步刷新
+	p, err = table.Value(k)
+	if err != nil || p.Data().(int32) != 1 {
+		t.Error("Error serving item while refreshing", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	p, err = table.Value(k)
+	if err != nil || p.Data().(int32) != 2 || atomic.LoadInt32(&loads) != 2 {
+		t.Error("Error refreshing item ahead of expiration", err)
+	}
+
+	// 刷新期间写入的条目不会被刷新结果覆盖
+	loading := make(chan bool)
+	release := make(chan bool)
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		loading <- true
+		<-release
+		return NewCacheItem(key, 200*time.Millisecond, "loaded")
+	})
+	time.Sleep(120 * time.Millisecond)
+	table.Value(k)
+	<-loading
+	table.Add(k, 200*time.Millisecond, "user-write")
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+
+	p, err = table.Value(k)
+	if err != nil || p.Data() != "user-write" {
+		t.Error("Refresh should not overwrite a concurrent write", err)
+	}
+}
+
+// 测试XFetch概率提前过期
+func TestXFetch(t *testing.T) {
+	table := testCache(t, "testXFetch")
+	// beta足够大，几乎每次访问都会提前刷新
+	table.SetXFetchBeta(1000)
+
+	var loads int32
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		time.Sleep(20 * time.Millisecond)
+		n := atomic.AddInt32(&loads, 1)
+		return NewCacheItem(key, time.Second, n)
+	})
+
+	p, err := table.Value(k)
+	if err != nil || p.ComputeTime() < 20*time.Millisecond {
+		t.Error("Error recording compute time", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		p, err = table.Value(k)
+		if err != nil || p.Data().(int32) != 1 {
+			t.Error("Error serving item while refreshing", err)
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if atomic.LoadInt32(&loads) != 2 {
+		t.Error("Error refreshing item early", atomic.LoadInt32(&loads))
+	}
+}
+
+// 测试批量加载
+func TestBatchLoader(t *testing.T) {
+	table := testCache(t, "testBatchLoader")
+
+	var m sync.Mutex
+	var batches [][]interface{}
+	table.SetBatchLoader(func(keys []interface{}) (map[interface{}]*CacheItem, error) {
+		m.Lock()
+		batches = append(batches, keys)
+		m.Unlock()
+
+		r := make(map[interface{}]*CacheItem)
+		for _, key := range keys {
+			if key.(int) >= 0 {
+				r[key] = NewCacheItem(key, 0, key.(int)*10)
+			}
+		}
+		return r, nil
+	})
+
+	table.Add(0, 0, 0)
+	r, err := table.ValuesMany([]interface{}{0, 1, 2, 3, -1})
+	if err != nil || len(r) != 4 || r[3].Data().(int) != 30 {
+		t.Error("Error loading values in batch", err)
+	}
+	if len(batches) != 1 || len(batches[0]) != 4 {
+		t.Error("Misses should be loaded in one batch", batches)
+	}
+	if !table.Exists(1) || table.Exists(-1) {
+		t.Error("Error adding loaded items to table")
+	}
+
+	// 匹配到路由的key用路由的加载函数加载，不会批量加载
+	table.AddPrefixLoader("user:", func(key interface{}, args ...interface{}) (*CacheItem, error) {
+		return NewCacheItem(key, 0, v), nil
+	})
+	r, err = table.ValuesMany([]interface{}{"user:1", 5})
+	if err != nil || len(r) != 2 || r["user:1"].Data() != v {
+		t.Error("Error loading routed keys", err, r)
+	}
+	if len(batches) != 2 || len(batches[1]) != 1 || batches[1][0] != 5 {
+		t.Error("Routed keys should not be loaded in batch", batches)
+	}
+
+	// 路由的key和并发的Value共享加载
+	var slowLoads int32
+	table.AddPrefixLoader("slow:", func(key interface{}, args ...interface{}) (*CacheItem, error) {
+		atomic.AddInt32(&slowLoads, 1)
+		time.Sleep(50 * time.Millisecond)
+		return NewCacheItem(key, 0, v), nil
+	})
+	loaded := make(chan struct{})
+	go func() {
+		defer close(loaded)
+		table.Value("slow:1")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if r, err := table.ValuesMany([]interface{}{"slow:1"}); err != nil || r["slow:1"] == nil {
+		t.Error("Error loading routed key", err)
+	}
+	<-loaded
+	if n := atomic.LoadInt32(&slowLoads); n != 1 {
+		t.Error("Routed keys should share in-flight loads", n)
+	}
+	table.RemoveLoaderRoutes()
+
+	// 合并窗口内的并发Value合并成一批
+	batches = nil
+	table.SetBatchWindow(20*time.Millisecond, 0)
+
+	var finish sync.WaitGroup
+	for i := 10; i < 20; i++ {
+		finish.Add(1)
+		go func(key int) {
+			defer finish.Done()
+			p, err := table.Value(key)
+			if err != nil || p.Data().(int) != key*10 {
+				t.Error("Error loading value through batch window", err)
+			}
+		}(i)
+	}
+	finish.Wait()
+
+	m.Lock()
+	if len(batches) != 1 || len(batches[0]) != 10 {
+		t.Error("Concurrent misses should be coalesced into one batch", batches)
+	}
+	m.Unlock()
+}
+
+// 测试加载策略
+func TestLoaderPolicy(t *testing.T) {
+	table := testCache(t, "testLoaderPolicy")
+	table.SetLoaderPolicy(LoaderPolicy{
+		Retries: 2,
+		Backoff: time.Millisecond,
+	})
+
+	// 失败两次后成功
+	var loads int32
+	table.SetLoader(func(key interface{}, args ...interface{}) (*CacheItem, error) {
+		if atomic.AddInt32(&loads, 1) <= 2 {
+			return nil, ErrKeyNotFound
+		}
+		return NewCacheItem(key, 0, v), nil
+	})
+
+	p, err := table.Value(k)
+	if err != nil || p.Data().(string) != v || atomic.LoadInt32(&loads) != 3 {
+		t.Error("Error retrying data loader", err)
+	}
+
+	// 超时
+	table.SetLoaderPolicy(LoaderPolicy{Timeout: 10 * time.Millisecond})
+	table.SetLoader(func(key interface{}, args ...interface{}) (*CacheItem, error) {
+		time.Sleep(100 * time.Millisecond)
+		return NewCacheItem(key, 0, v), nil
+	})
+
+	_, err = table.Value(k + "_timeout")
+	if err != ErrLoaderTimeout || table.Exists(k+"_timeout") {
+		t.Error("Error timing out data loader", err)
+	}
+
+	// 连续失败两次后熔断
+	table.SetLoaderPolicy(LoaderPolicy{
+		BreakerThreshold: 2,
+		BreakerCooldown: 50 * time.Millisecond,
+	})
+	loads = 0
+	failing := true
+	table.SetLoader(func(key interface{}, args ...interface{}) (*CacheItem, error) {
+		atomic.AddInt32(&loads, 1)
+		if failing {
+			return nil, ErrKeyNotFound
+		}
+		return NewCacheItem(key, 0, v), nil
+	})
+
+	table.Value(k + "_1")
+	table.Value(k + "_2")
+	_, err = table.Value(k + "_3")
+	if err != ErrCircuitOpen || atomic.LoadInt32(&loads) != 2 {
+		t.Error("Error opening circuit breaker", err)
+	}
+	if table.Stats().BreakerState != BreakerOpen {
+		t.Error("Error reporting circuit breaker state")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	// 冷却结束，试探成功后恢复
+	failing = false
+	_, err = table.Value(k + "_3")
+	if err != nil || table.Stats().BreakerState != BreakerClosed {
+		t.Error("Error closing circuit breaker", err)
+	}
+
+	// 加载失败和熔断时返回旧值
+	table.SetLoaderPolicy(LoaderPolicy{
+		BreakerThreshold: 1,
+		BreakerCooldown: time.Hour,
+		ServeStale: true,
+	})
+	var fail int32
+	table.SetLoader(func(key interface{}, args ...interface{}) (*CacheItem, error) {
+		if atomic.LoadInt32(&fail) == 1 {
+			return nil, ErrLoaderTimeout
+		}
+		return NewCacheItem(key, 20*time.Millisecond, v), nil
+	})
+	if _, err := table.Value(k + "_stale"); err != nil {
+		t.Error("Error loading item", err)
+	}
+	atomic.StoreInt32(&fail, 1)
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		p, err := table.Value(k + "_stale")
+		if err != nil || p.Data() != v {
+			t.Error("Error serving stale item", err)
+		}
+	}
+	if table.Stats().BreakerState != BreakerOpen || table.Exists(k + "_stale") {
+		t.Error("Stale items should not be added back")
+	}
+	table.Delete(k + "_stale")
+	if _, err := table.Value(k + "_stale"); err != ErrCircuitOpen {
+		t.Error("Deleted items should not be served stale", err)
+	}
+}
+
+// 测试加载并发上限
+func TestLoaderConcurrency(t *testing.T) {
+	table := testCache(t, "testLoaderConcurrency")
+	table.SetLoaderPolicy(LoaderPolicy{MaxConcurrent: 2})
+
+	var running, peak int32
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return NewCacheItem(key, 0, v)
+	})
+
+	var finish sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		finish.Add(1)
+		go func(key int) {
+			defer finish.Done()
+			table.Value(key)
+		}(i)
+	}
+	finish.Wait()
+
+	if peak > 2 || table.Stats().LoadSuccesses != 6 {
+		t.Error("Error limiting concurrent loads", peak)
+	}
+
+	// 等待并发名额的时间计入超时
+	table.SetLoaderPolicy(LoaderPolicy{MaxConcurrent: 1, Timeout: 50 * time.Millisecond})
+	release := make(chan bool)
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		<-release
+		return NewCacheItem(key, 0, v)
+	})
+	defer close(release)
+
+	go table.Value("slow")
+	time.Sleep(10 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := table.Value("waiting"); err != ErrLoaderTimeout || time.Since(start) > 200*time.Millisecond {
+		t.Error("Waiting for a loader slot should time out", err, time.Since(start))
+	}
+}
+
+// 测试加载函数路由和串联
+func TestLoaderRoutes(t *testing.T) {
+	table := testCache(t, "testLoaderRoutes")
+
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, "default")
+	})
+	table.AddPrefixLoader("user:", func(key interface{}, args ...interface{}) (*CacheItem, error) {
+		return NewCacheItem(key, 0, "user"), nil
+	})
+	table.AddLoaderRoute(func(key interface{}) bool {
+		_, ok := key.(int)
+		return ok
+	}, ChainLoaders(
+		func(key interface{}, args ...interface{}) (*CacheItem, error) {
+			return nil, ErrLoaderTimeout
+		},
+		func(key interface{}, args ...interface{}) (*CacheItem, error) {
+			if key.(int) > 0 {
+				return nil, nil
+			}
+			return NewCacheItem(key, 0, "file"), nil
+		},
+		func(key interface{}, args ...interface{}) (*CacheItem, error) {
+			return NewCacheItem(key, 0, "fallback"), nil
+		},
+	))
+
+	expected := map[interface{}]string{
+		"user:1": "user",
+		"other": "default",
+		0: "file",
+		1: "fallback",
+	}
+	for key, data := range expected {
+		p, err := table.Value(key)
+		if err != nil || p.Data().(string) != data {
+			t.Error("Error routing data loader for", key, err)
+		}
+	}
+
+	// 都失败时返回错误
+	table.RemoveLoaderRoutes()
+	table.AddPrefixLoader("bad:", ChainLoaders(
+		func(key interface{}, args ...interface{}) (*CacheItem, error) {
+			return nil, ErrLoaderTimeout
+		},
+		func(key interface{}, args ...interface{}) (*CacheItem, error) {
+			return nil, nil
+		},
+	))
+	if _, err := table.Value("bad:1"); err != ErrLoaderTimeout {
+		t.Error("Error returning chained loader error", err)
+	}
+
+	// match panic时返回错误，不会一直持有表的锁
+	var reported int32
+	table.SetOnError(func(err error) {
+		atomic.AddInt32(&reported, 1)
+	})
+	table.AddLoaderRoute(func(key interface{}) bool {
+		panic("bad matcher")
+	}, ChainLoaders())
+	if _, err := table.Value("panic"); !errors.Is(err, ErrCallbackPanic) {
+		t.Error("Panicking matcher should return an error", err)
+	}
+	if _, err := table.ValuesMany([]interface{}{"panic"}); !errors.Is(err, ErrCallbackPanic) {
+		t.Error("Panicking matcher should fail ValuesMany", err)
+	}
+	if table.Add(k, 0, v); !table.Exists(k) {
+		t.Error("Table should be usable after a matcher panicked")
+	}
+	if atomic.LoadInt32(&reported) != 2 {
+		t.Error("Matcher panics should be reported", atomic.LoadInt32(&reported))
+	}
+}
+
+// 测试用的存储
+type testStore struct {
+	sync.Mutex
+	data map[interface{}]interface{}
+	// Store调用的次数
+	writes int
+	// 接下来Store失败的次数
+	failures int
+	// 接下来Delete失败的次数
+	deleteFailures int
+	// 接下来Store panic的次数
+	panics int
+	// 每次Store成功后调用
+	onStore func(key interface{})
+}
+
+func newTestStore() *testStore {
+	return &testStore{data: make(map[interface{}]interface{})}
+}
+
+func (s *testStore) Load(key interface{}) (interface{}, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	data, ok := s.data[key]
+	return data, ok, nil
+}
+
+func (s *testStore) Store(key interface{}, data interface{}) error {
+	s.Lock()
+	if s.panics > 0 {
+		s.panics--
+		s.Unlock()
+		panic("store failed")
+	}
+	if s.failures > 0 {
+		s.failures--
+		s.Unlock()
+		return ErrLoaderTimeout
+	}
+	s.writes++
+	s.data[key] = data
+	onStore := s.onStore
+	s.Unlock()
+
+	if onStore != nil {
+		onStore(key)
+	}
+	return nil
+}
+
+func (s *testStore) Delete(key interface{}) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.deleteFailures > 0 {
+		s.deleteFailures--
+		return ErrLoaderTimeout
+	}
+	delete(s.data, key)
+	return nil
+}
+
+// 测试同步写入存储
+func TestWriteThrough(t *testing.T) {
+	table := testCache(t, "testWriteThrough")
+	store := newTestStore()
+	store.data[k+"_stored"] = v
+	table.BindStore(store, StoreOptions{Mode: WriteThrough})
+
+	// 从存储加载
+	p, err := table.Value(k + "_stored")
+	if err != nil || p.Data().(string) != v {
+		t.Error("Error loading data from store", err)
+	}
+	if store.writes != 0 {
+		t.Error("Loaded items should not be written back")
+	}
+
+	table.Add(k, 0, v)
+	if _, ok, _ := store.Load(k); !ok {
+		t.Error("Error writing data through to store")
+	}
+
+	// 写入存储失败时不修改缓存，并返回错误
+	store.failures = 1
+	if _, err := table.TryAdd(k, 0, "failed"); !errors.Is(err, ErrLoaderTimeout) {
+		t.Error("TryAdd should return the store error", err)
+	}
+	if p, _ := table.Value(k); p.Data() != v {
+		t.Error("Failed writes should not change the cache")
+	}
+	store.failures = 1
+	if _, err := table.Replace(k, 0, "failed"); !errors.Is(err, ErrLoaderTimeout) {
+		t.Error("Replace should return the store error", err)
+	}
+	store.failures = 1
+	if _, err := table.Incr("counter", 1, 0); !errors.Is(err, ErrLoaderTimeout) || table.Exists("counter") {
+		t.Error("Incr should return the store error", err)
+	}
+	store.deleteFailures = 1
+	if _, err := table.Delete(k); !errors.Is(err, ErrLoaderTimeout) || !table.Exists(k) {
+		t.Error("Delete should return the store error", err)
+	}
+	if p, _ := table.Value(k); p.Data() != v {
+		t.Error("Failed writes should not change the cache")
+	}
+
+	table.Delete(k)
+	if _, ok, _ := store.Load(k); ok {
+		t.Error("Error deleting data from store")
+	}
+
+	// 写入存储期间条目被清除了，失败的操作恢复存储中原来的数据
+	p = table.Add(k, 0, "v1")
+	store.onStore = func(key interface{}) {
+		if key == k {
+			store.onStore = nil
+			table.Flush()
+		}
+	}
+	if _, err := table.CompareAndSwap(k, p.Version(), "v2"); err != ErrKeyNotFound {
+		t.Error("CompareAndSwap should fail after a flush", err)
+	}
+	if data, _, _ := store.Load(k); data != "v1" {
+		t.Error("Failed CompareAndSwap should not change the store", data)
+	}
+
+	table.Add(k, 0, "v1")
+	store.onStore = func(key interface{}) {
+		if key == k {
+			store.onStore = nil
+			table.Flush()
+		}
+	}
+	if _, err := table.Replace(k, 0, "v2"); err != ErrKeyNotFound {
+		t.Error("Replace should fail after a flush", err)
+	}
+	if data, _, _ := store.Load(k); data != "v1" {
+		t.Error("Failed Replace should not change the store", data)
+	}
+}
+
+// 测试缓冲写入存储
+func TestWriteBehind(t *testing.T) {
+	table := testCache(t, "testWriteBehind")
+	store := newTestStore()
+	store.failures = 1
+	table.BindStore(store, StoreOptions{
+		Mode: WriteBehind,
+		FlushInterval: time.Hour,
+		MaxRetries: 1,
+	})
+
+	for i := 0; i < 10; i++ {
+		table.Add(k, 0, i)
+	}
+	table.Add(k+"_deleted", 0, v)
+	table.Delete(k + "_deleted")
+
+	if store.writes != 0 {
+		t.Error("Writes should be buffered")
+	}
+
+	// 缓冲的删除对加载可见
+	table.Flush()
+	if _, err := table.Value(k + "_deleted"); err == nil {
+		t.Error("Pending delete should be visible to loader")
+	}
+
+	if err := table.Close(); err != nil {
+		t.Error("Error draining write-behind buffer", err)
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	if store.writes != 1 || store.data[k] != 9 {
+		t.Error("Writes should be coalesced per key", store.writes)
+	}
+	if _, ok := store.data[k+"_deleted"]; ok {
+		t.Error("Error deleting data from store")
+	}
+}
+
+// 测试存储panic
+func TestStorePanic(t *testing.T) {
+	table := testCache(t, "testStorePanic")
+
+	var reported int32
+	table.SetOnError(func(err error) {
+		if errors.Is(err, ErrStorePanic) {
+			atomic.AddInt32(&reported, 1)
+		}
+	})
+
+	// 同步写入时返回错误，不修改缓存
+	store := newTestStore()
+	store.panics = 1
+	table.BindStore(store, StoreOptions{Mode: WriteThrough})
+	if _, err := table.TryAdd(k, 0, v); !errors.Is(err, ErrStorePanic) || table.Exists(k) {
+		t.Error("Store panic should fail the write", err)
+	}
+
+	// 缓冲写入时算作写入失败，重试后写入
+	store = newTestStore()
+	store.panics = 1
+	table.BindStore(store, StoreOptions{
+		Mode: WriteBehind,
+		FlushInterval: time.Hour,
+		MaxRetries: 1,
+	})
+	table.Add(k, 0, v)
+	if err := table.Close(); err != nil {
+		t.Error("Panicked writes should be retried", err)
+	}
+	if data, _, _ := store.Load(k); data != v {
+		t.Error("Error retrying panicked write", data)
+	}
+
+	if n := atomic.LoadInt32(&reported); n != 2 {
+		t.Error("Store panics should be reported", n)
+	}
+}
+
+// 测试缓存预热
+func TestWarmer(t *testing.T) {
+	// 热点key
+	hot := testCache(t, "testWarmerHot")
+	for i := 0; i < 10; i++ {
+		hot.Add(i, 0, v)
+		for j := 0; j < i; j++ {
+			hot.Value(i)
+		}
+	}
+	keys := hot.HotKeys(5)
+	if len(keys) != 5 || keys[0] != 9 {
+		t.Error("Error getting hot keys", keys)
+	}
+
+	var loads, reports int32
+	t.Cleanup(func() {
+		dropTestCache("testWarmer")
+	})
+	table, err := CacheWithWarmer("testWarmer", Warmer{
+		Loader: func(key interface{}, args ...interface{}) (*CacheItem, error) {
+			atomic.AddInt32(&loads, 1)
+			return NewCacheItem(key, 0, v), nil
+		},
+		Keys: func() ([]interface{}, error) {
+			return keys, nil
+		},
+		Concurrency: 3,
+		Progress: func(done, total int, key interface{}, err error) {
+			atomic.AddInt32(&reports, 1)
+			if total != 5 || err != nil {
+				t.Error("Error reporting warm progress", done, total, err)
+			}
+		},
+	})
+	if err != nil || table.Count() != 5 || loads != 5 || reports != 5 {
+		t.Error("Error warming table", err)
+	}
+	if Cache("testWarmer") != table {
+		t.Error("Warmed table should be registered")
+	}
+
+	// 已经存在的key跳过
+	n, err := table.Warm([]interface{}{9, 100}, 2)
+	if err != nil || n != 1 || loads != 6 {
+		t.Error("Error warming existing keys", n, err)
+	}
+
+	// 预热期间同一个key的Value共享加载
+	slow := testCache(t, "testWarmerShared")
+	var slowLoads int32
+	slow.SetLoader(func(key interface{}, args ...interface{}) (*CacheItem, error) {
+		atomic.AddInt32(&slowLoads, 1)
+		time.Sleep(50 * time.Millisecond)
+		return NewCacheItem(key, 0, v), nil
+	})
+	warmed := make(chan struct{})
+	go func() {
+		defer close(warmed)
+		slow.Warm([]interface{}{k}, 1)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := slow.Value(k); err != nil {
+		t.Error("Error loading key during warm-up", err)
+	}
+	<-warmed
+	if n := atomic.LoadInt32(&slowLoads); n != 1 {
+		t.Error("Warm-up and Value should share the load", n)
+	}
+
+	// 只有批量加载函数
+	batched := testCache(t, "testWarmerBatch")
+	if _, err := batched.Warm([]interface{}{1, 2}, 2); !errors.Is(err, ErrNoLoader) {
+		t.Error("Warming without a loader should fail", err)
+	}
+	var batches int32
+	batched.SetBatchLoader(func(keys []interface{}) (map[interface{}]*CacheItem, error) {
+		atomic.AddInt32(&batches, 1)
+		r := make(map[interface{}]*CacheItem)
+		for _, key := range keys {
+			r[key] = NewCacheItem(key, 0, v)
+		}
+		return r, nil
+	})
+	if n, err := batched.Warm([]interface{}{1, 2, 3}, 2); err != nil || n != 3 || batched.Count() != 3 {
+		t.Error("Error warming with batch loader", n, err)
+	}
+	if atomic.LoadInt32(&batches) != 1 {
+		t.Error("Keys should be warmed in one batch", batches)
+	}
+}
+
+// 测试异步访问
+func TestAsyncTable(t *testing.T) {
+	table := testCache(t, "testAsyncTable")
+
+	var loads int32
+	release := make(chan struct{})
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return NewCacheItem(key, 0, v)
+	})
+	table.Add(k, 0, v)
+
+	async := NewAsyncTable(table, 4)
+
+	// 命中时直接完成
+	select {
+	case <-async.Value(k).Done():
+	default:
+		t.Error("Future of cached item should be completed")
+	}
+
+	// 同一个key共享Future
+	var futures []*Future
+	for i := 0; i < 10; i++ {
+		futures = append(futures, async.Value(i%5))
+	}
+	if futures[0] != futures[5] || async.Inflight() != 5 {
+		t.Error("Concurrent callers should share in-flight futures")
+	}
+
+	// 其他AsyncTable和同步的Value也共享正在进行的加载
+	if NewAsyncTable(table, 1).Value(0) != futures[0] {
+		t.Error("Async tables should share in-flight futures")
+	}
+	syncDone := make(chan *CacheItem)
+	go func() {
+		p, _ := table.Value(1)
+		syncDone <- p
+	}()
+
+	close(release)
+	items, errs := Await(futures...)
+	for i := range futures {
+		if errs[i] != nil || items[i].Key() != i%5 {
+			t.Error("Error awaiting futures", errs[i])
+		}
+	}
+	if p := <-syncDone; p != items[1] {
+		t.Error("Value should share in-flight loads")
+	}
+	if n := atomic.LoadInt32(&loads); n != 5 || async.Inflight() != 0 || table.Count() != 6 {
+		t.Error("Error loading through async table", n)
+	}
+
+	// 命中时同样会提前刷新
+	table.SetRefreshThreshold(0.5)
+	table.Add("refresh", 100*time.Millisecond, v)
+	time.Sleep(60 * time.Millisecond)
+	async.Value("refresh").Get()
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&loads); n != 6 {
+		t.Error("Async hits should refresh ahead", n)
+	}
+}
+
+// 测试移除原因
+func TestRemovalCause(t *testing.T) {
+	table := testCache(t, "testRemovalCause")
+
+	var m sync.Mutex
+	causes := make(map[interface{}]RemovalCause)
+	table.AddRemovalListener(func(item *CacheItem, cause RemovalCause) {
+		m.Lock()
+		causes[item.Key()] = cause
+		m.Unlock()
+	})
+
+	table.Add(k+"_deleted", 0, v)
+	table.Add(k+"_expired", 50*time.Millisecond, v)
+	table.Delete(k + "_deleted")
+
+	time.Sleep(100 * time.Millisecond)
+
+	m.Lock()
+	defer m.Unlock()
+	if len(causes) != 2 || causes[k+"_deleted"] != RemovalExplicit || causes[k+"_expired"] != RemovalExpired {
+		t.Error("Error reporting removal cause", causes)
+	}
+	if RemovalExpired.String() != "expired" {
+		t.Error("Error describing removal cause")
+	}
+}
+
+// 测试替换条目
+func TestReplace(t *testing.T) {
+	table := testCache(t, "testReplace")
+
+	var m sync.Mutex
+	var causes []RemovalCause
+	table.AddRemovalListener(func(item *CacheItem, cause RemovalCause) {
+		m.Lock()
+		causes = append(causes, cause)
+		m.Unlock()
+	})
+
+	if _, err := table.Replace(k, 0, v); err != ErrKeyNotFound || table.Exists(k) {
+		t.Error("Replace should not add missing key", err)
+	}
+
+	item, old := table.AddOrUpdate(k, 0, v+"_1")
+	if item.Data().(string) != v+"_1" || old != nil {
+		t.Error("Error adding item")
+	}
+
+	expired := false
+	item.AddAboutToExpireCallback(func(key interface{}) {
+		expired = true
+	})
+
+	item, old = table.AddOrUpdate(k, 0, v+"_2")
+	if old == nil || old.Data().(string) != v+"_1" || !expired {
+		t.Error("Error replacing item")
+	}
+
+	old, err := table.Replace(k, 0, v+"_3")
+	if err != nil || old != item {
+		t.Error("Error returning replaced item", err)
+	}
+
+	p, _ := table.Value(k)
+	if p.Data().(string) != v+"_3" {
+		t.Error("Error retrieving replaced item")
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if len(causes) != 2 || causes[0] != RemovalReplaced || causes[1] != RemovalReplaced {
+		t.Error("Replaced items should notify removal listeners", causes)
+	}
+}
+
+// 测试Flush触发回调函数和按条件删除
+func TestFlushWhere(t *testing.T) {
+	table := testCache(t, "testFlushWhere")
+
+	var m sync.Mutex
+	causes := make(map[interface{}]RemovalCause)
+	table.AddRemovalListener(func(item *CacheItem, cause RemovalCause) {
+		m.Lock()
+		causes[item.Key()] = cause
+		m.Unlock()
+	})
+
+	for i := 0; i < 10; i++ {
+		table.Add(i, 0, i)
+	}
+
+	// 不触发回调函数
+	n := table.FlushWhere(func(key interface{}, item *CacheItem) bool {
+		return key.(int) < 2
+	})
+	if n != 2 || table.Count() != 8 || len(causes) != 0 {
+		t.Error("Error flushing items by predicate", n)
+	}
+
+	n = table.FlushWhere(func(key interface{}, item *CacheItem) bool {
+		return key.(int) < 4
+	}, FlushWithCallbacks())
+	if n != 2 || causes[2] != RemovalFlushed || causes[3] != RemovalFlushed {
+		t.Error("Error flushing items with callbacks", n)
+	}
+
+	// pred中可以访问缓存表
+	n = table.DeleteFunc(func(key interface{}, item *CacheItem) bool {
+		return table.Exists(key) && item.Data().(int)%2 == 0
+	})
+	if n != 3 || table.Count() != 3 || causes[4] != RemovalExplicit {
+		t.Error("Error deleting items by predicate", n)
+	}
+
+	// 调用pred后被替换的条目不会删除
+	n = table.DeleteFunc(func(key interface{}, item *CacheItem) bool {
+		if key == 5 {
+			table.Add(5, 0, 7)
+			return true
+		}
+		return false
+	})
+	if p, err := table.Value(5); n != 0 || err != nil || p.Data() != 7 {
+		t.Error("Replaced items should not be deleted", n, err)
+	}
+
+	table.Flush(FlushWithCallbacks())
+	if table.Count() != 0 || causes[9] != RemovalFlushed || len(causes) != 8 {
+		t.Error("Error flushing table with callbacks")
+	}
+}
+
+// 测试异步分发回调函数
+func TestCallbackDispatch(t *testing.T) {
+	table := testCache(t, "testCallbackDispatch")
+	table.SetCallbackDispatch(DispatchOptions{
+		Workers: 2,
+		QueueSize: 1,
+		Overflow: OverflowSpill,
+	})
+
+	var m sync.Mutex
+	order := make(map[interface{}][]interface{})
+	table.AddAddedItemCallback(func(item *CacheItem) {
+		time.Sleep(time.Millisecond)
+		m.Lock()
+		order[item.Key()] = append(order[item.Key()], item.Data())
+		m.Unlock()
+	})
+
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		table.Add(i%4, 0, i)
+	}
+	if time.Since(start) >= 20*time.Millisecond {
+		t.Error("Callbacks should not block Add")
+	}
+
+	table.Drain()
+
+	m.Lock()
+	for key, data := range order {
+		for i, d := range data {
+			if d.(int) != key.(int)+i*4 {
+				t.Error("Callbacks for the same key should be ordered", key, data)
+				break
+			}
+		}
+	}
+	m.Unlock()
+
+	// 队列满了丢弃
+	release := make(chan struct{})
+	table.RemoveAddedItemCallbacks()
+	table.SetCallbackDispatch(DispatchOptions{
+		Workers: 1,
+		QueueSize: 1,
+		Overflow: OverflowDrop,
+	})
+	table.AddAddedItemCallback(func(item *CacheItem) {
+		<-release
+	})
+
+	for i := 0; i < 5; i++ {
+		table.Add(i, 0, i)
+	}
+	close(release)
+	table.Drain()
+
+	dropped := table.Stats().DroppedCallbacks
+	if dropped < 3 {
+		t.Error("Error dropping callbacks on overflow", dropped)
+	}
+
+	// 没有回调函数时不占用分发队列
+	table.RemoveAddedItemCallbacks()
+	release = make(chan struct{})
+	sub := table.AddAddedItemCallback(func(item *CacheItem) {
+		<-release
+	})
+	table.Add("blocking", 0, v)
+	sub.Unsubscribe()
+	for i := 0; i < 100; i++ {
+		table.Add(i, 0, i)
+		table.Delete(i)
+	}
+	close(release)
+	table.Drain()
+
+	if table.Stats().DroppedCallbacks != dropped {
+		t.Error("Nothing should be dispatched without callbacks", table.Stats().DroppedCallbacks)
+	}
+}
+
+// 测试回调函数和加载函数的panic
+func TestCallbackPanic(t *testing.T) {
+	table := testCache(t, "testCallbackPanic")
+
+	var m sync.Mutex
+	var errs []error
+	table.SetOnError(func(err error) {
+		m.Lock()
+		errs = append(errs, err)
+		m.Unlock()
+	})
+
+	called := false
+	table.AddAddedItemCallback(func(item *CacheItem) {
+		panic("added")
+	})
+	table.AddAddedItemCallback(func(item *CacheItem) {
+		called = true
+	})
+	table.AddAboutToDeleteItemCallback(func(item *CacheItem) {
+		panic("deleted")
+	})
+
+	table.Add(k+"_1", 50*time.Millisecond, v)
+	table.Add(k+"_2", 75*time.Millisecond, v)
+	if !called {
+		t.Error("Callbacks after a panicking callback should be called")
+	}
+
+	// 过期检测没有被panic中断
+	time.Sleep(150 * time.Millisecond)
+	if table.Count() != 0 {
+		t.Error("Error expiring items after callback panic")
+	}
+
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		panic("loader")
+	})
+	_, err := table.Value(k)
+	if !errors.Is(err, ErrLoaderPanic) {
+		t.Error("Loader panic should be converted to error", err)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	// 添加2次、删除2次、加载1次
+	if len(errs) != 5 || !errors.Is(errs[0], ErrCallbackPanic) {
+		t.Error("Error reporting panics", errs)
+	}
+}
+
+// 测试单独取消回调函数
+func TestSubscription(t *testing.T) {
+	table := testCache(t, "testSubscription")
+
+	var added1, added2, deleted, removed, expired1, expired2 int
+	sub := table.AddAddedItemCallback(func(item *CacheItem) {
+		added1++
+	})
+	table.AddAddedItemCallback(func(item *CacheItem) {
+		added2++
+	})
+	table.AddAboutToDeleteItemCallback(func(item *CacheItem) {
+		deleted++
+	}).Unsubscribe()
+	table.AddRemovalListener(func(item *CacheItem, cause RemovalCause) {
+		removed++
+	}).Unsubscribe()
+
+	i := table.Add(k, 0, v)
+	i.AddAboutToExpireCallback(func(key interface{}) {
+		expired1++
+	}).Unsubscribe()
+	i.AddAboutToExpireCallback(func(key interface{}) {
+		expired2++
+	})
+
+	sub.Unsubscribe()
+	// 多次取消不会出错
+	sub.Unsubscribe()
+
+	table.Add(k+"_2", 0, v)
+	table.Delete(k)
+
+	if added1 != 1 || added2 != 2 {
+		t.Error("Error unsubscribing added item callback", added1, added2)
+	}
+	if deleted != 0 || removed != 0 {
+		t.Error("Error unsubscribing removal callbacks")
+	}
+	if expired1 != 0 || expired2 != 1 {
+		t.Error("Error unsubscribing item expiry callback")
+	}
+}
+
+// 测试事件流
+func TestSubscribe(t *testing.T) {
+	table := testCache(t, "testSubscribe")
+
+	all := table.Subscribe(nil, 10)
+	removed := table.Subscribe(func(e Event) bool {
+		return e.Type == EventRemoved
+	}, 10)
+	small := table.Subscribe(nil, 1)
+
+	table.Add(k, 0, v)
+	table.Add(k, 0, v+"_2")
+	table.Value(k)
+	table.Delete(k)
+
+	expected := []EventType{EventAdded, EventUpdated, EventAccessed, EventRemoved}
+	for _, et := range expected {
+		e := <-all.C
+		if e.Type != et || e.Key != k {
+			t.Error("Error receiving event", et, e.Type)
+		}
+		if et == EventRemoved && e.Item.Data().(string) != v+"_2" {
+			t.Error("Event should carry item snapshot")
+		}
+	}
+
+	e := <-removed.C
+	if e.Type != EventRemoved || e.Cause != RemovalExplicit || e.Time.IsZero() {
+		t.Error("Error filtering events", e.Type)
+	}
+
+	if small.Dropped() != 3 {
+		t.Error("Error counting dropped events", small.Dropped())
+	}
+
+	all.Unsubscribe()
+	table.Add(k, 0, v)
+	if _, ok := <-all.C; ok {
+		t.Error("Unsubscribed stream should be closed")
+	}
+}
+
+// 测试拦截器
+func TestInterceptor(t *testing.T) {
+	table := testCache(t, "testInterceptor")
+
+	errTooLarge := errors.New("too large")
+	var m sync.Mutex
+	var ops []OpKind
+	table.AddInterceptor(Interceptor{
+		// 规范化key，拒绝过大的data
+		Before: func(op *Op) error {
+			if s, ok := op.Key.(string); ok {
+				op.Key = strings.ToLower(s)
+			}
+			if s, ok := op.Data.(string); ok && len(s) > 10 {
+				return errTooLarge
+			}
+			return nil
+		},
+		After: func(op *Op, item *CacheItem, err error) {
+			m.Lock()
+			ops = append(ops, op.Kind)
+			m.Unlock()
+		},
+	})
+	sub := table.AddInterceptor(Interceptor{
+		// 加载函数加载到的条目也会经过拦截器
+		Before: func(op *Op) error {
+			if op.Kind == OpAdd && op.LifeSpan == 0 {
+				op.LifeSpan = time.Minute
+			}
+			return nil
+		},
+	})
+
+	table.Add("KEY", 0, v)
+	p, err := table.Value("Key")
+	if err != nil || p.Key() != "key" || p.LifeSpan() != time.Minute {
+		t.Error("Error rewriting operation", err)
+	}
+
+	if _, err := table.TryAdd(k, 0, "0123456789abcdef"); err != errTooLarge || table.Exists(k) {
+		t.Error("Error aborting add", err)
+	}
+
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 0, "0123456789abcdef")
+	})
+	if _, err := table.Value("loaded"); err != errTooLarge || table.Exists("loaded") {
+		t.Error("Loaded items should be intercepted", err)
+	}
+
+	sub.Unsubscribe()
+	if _, err := table.Delete("KEY"); err != nil || table.Count() != 0 {
+		t.Error("Error deleting through interceptor", err)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	expected := []OpKind{OpAdd, OpValue, OpAdd, OpAdd, OpValue, OpDelete}
+	if len(ops) != len(expected) {
+		t.Error("Error calling After hooks", ops)
+	}
+	for i := range ops {
+		if i < len(expected) && ops[i] != expected[i] {
+			t.Error("Error calling After hooks in order", ops)
+			break
+		}
+	}
+}
+
+// 测试条目带移除原因的回调函数
+func TestItemRemovalListener(t *testing.T) {
+	table := testCache(t, "testItemRemovalListener")
+
+	var m sync.Mutex
+	removed := map[interface{}]RemovalCause{}
+	listener := func(item *CacheItem, cause RemovalCause) {
+		m.Lock()
+		defer m.Unlock()
+		removed[item.Data()] = cause
+	}
+
+	table.Add(k, 0, "first", WithRemovalListener(listener))
+	table.Add(k, 0, "second", WithRemovalListener(listener))
+	table.Value(k)
+	table.Delete(k)
+
+	// 加载函数返回的条目上的回调函数不会丢失
+	table.SetDataLoader(func(key interface{}, args ...interface{}) *CacheItem {
+		return NewCacheItem(key, 50*time.Millisecond, "loaded", WithRemovalListener(listener))
+	})
+	table.Value("loaded")
+
+	item := table.Add("unsubscribed", 0, "unsubscribed")
+	item.AddRemovalListener(listener).Unsubscribe()
+	table.Delete("unsubscribed")
+
+	time.Sleep(150 * time.Millisecond)
+
+	m.Lock()
+	defer m.Unlock()
+	if removed["first"] != RemovalReplaced || removed["second"] != RemovalExplicit || removed["loaded"] != RemovalExpired {
+		t.Error("Error calling item removal listeners", removed)
+	}
+	if _, ok := removed["unsubscribed"]; ok {
+		t.Error("Unsubscribed listener should not be called")
+	}
+}
+
+// 测试监听key
+func TestWatch(t *testing.T) {
+	table := testCache(t, "testWatch")
+
+	w := table.Watch(k, 10)
+	p := table.WatchPrefix("config.", 10)
+
+	table.Add(k, 0, v)
+	table.Add(k, 0, v+"2")
+	table.Value(k)
+	table.Add("config.timeout", 0, 10)
+	table.Add(1, 0, "other")
+	table.Delete(k)
+	table.Delete("config.timeout")
+
+	for _, expected := range []EventType{EventAdded, EventUpdated, EventAccessed, EventRemoved} {
+		e := <-w.C
+		if e.Key != k || e.Type != expected {
+			t.Error("Error watching key", e.Key, e.Type, expected)
+		}
+	}
+	for _, expected := range []EventType{EventAdded, EventRemoved} {
+		e := <-p.C
+		if e.Key != "config.timeout" || e.Type != expected {
+			t.Error("Error watching prefix", e.Key, e.Type, expected)
+		}
+	}
+
+	w.Unsubscribe()
+	p.Unsubscribe()
+	if _, ok := <-w.C; ok {
+		t.Error("Watch should only receive events of its key")
+	}
+	if _, ok := <-p.C; ok {
+		t.Error("WatchPrefix should only receive events of matching keys")
+	}
+}
+
+// 测试原子读改写
+func TestCompute(t *testing.T) {
+	table := testCache(t, "testCompute")
+
+	var m sync.Mutex
+	causes := []RemovalCause{}
+	table.AddRemovalListener(func(item *CacheItem, cause RemovalCause) {
+		m.Lock()
+		defer m.Unlock()
+		causes = append(causes, cause)
+	})
+
+	if _, err := table.Update(k, func(old interface{}) (interface{}, bool) {
+		return old, true
+	}); err != ErrKeyNotFound {
+		t.Error("Update should fail on missing key", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			table.Compute(k, time.Minute, func(old *CacheItem) (interface{}, bool) {
+				if old == nil {
+					return 1, true
+				}
+				return old.Data().(int) + 1, true
+			})
+		}()
+	}
+	wg.Wait()
+
+	p, err := table.Value(k)
+	if err != nil || p.Data().(int) != 100 || p.LifeSpan() != time.Minute {
+		t.Error("Error computing concurrently", err)
+	}
+
+	// 保留保活时间
+	p, err = table.Update(k, func(old interface{}) (interface{}, bool) {
+		return old.(int) * 2, true
+	})
+	if err != nil || p.Data().(int) != 200 || p.LifeSpan() != time.Minute {
+		t.Error("Error updating item", err)
+	}
+
+	// 返回false删除条目
+	if p, _ = table.Update(k, func(old interface{}) (interface{}, bool) {
+		return nil, false
+	}); p != nil || table.Exists(k) {
+		t.Error("Error deleting item in Update")
+	}
+
+	calls := 0
+	for i := 0; i < 2; i++ {
+		p, err = table.GetOrCompute(k, 0, func() (interface{}, error) {
+			calls++
+			return v, nil
+		})
+		if err != nil || p.Data() != v {
+			t.Error("Error getting or computing item", err)
+		}
+	}
+	if calls != 1 || p.AccessCount() != 1 {
+		t.Error("GetOrCompute should only compute missing items", calls)
+	}
+
+	errCompute := errors.New("compute")
+	if _, err = table.GetOrCompute("failed", 0, func() (interface{}, error) {
+		return nil, errCompute
+	}); err != errCompute || table.Exists("failed") {
+		t.Error("Failed computations should not be added", err)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if len(causes) != 101 || causes[99] != RemovalReplaced || causes[100] != RemovalExplicit {
+		t.Error("Error calling removal listeners", len(causes))
+	}
+}
+
+// 测试版本号和CAS
+func TestCompareAndSwap(t *testing.T) {
+	table := testCache(t, "testCompareAndSwap")
+
+	first := table.Add(k, time.Minute, 1)
+	second := table.Add("other", 0, 1)
+	if first.Version() == 0 || second.Version() <= first.Version() {
+		t.Error("Versions should increase monotonically")
+	}
+
+	p, err := table.Value(k)
+	if err != nil || p.Version() != first.Version() {
+		t.Error("Value should return the item version", err)
+	}
+
+	swapped, err := table.CompareAndSwap(k, p.Version(), 2)
+	if err != nil || swapped.Data() != 2 || swapped.Version() <= p.Version() || swapped.LifeSpan() != time.Minute {
+		t.Error("Error swapping item", err)
+	}
+	if _, err = table.CompareAndSwap(k, p.Version(), 3); err != ErrVersionMismatch {
+		t.Error("Stale version should fail to swap", err)
+	}
+	if _, err = table.CompareAndDelete(k, p.Version()); err != ErrVersionMismatch || !table.Exists(k) {
+		t.Error("Stale version should fail to delete", err)
+	}
+	if _, err = table.CompareAndSwap("missing", 1, 3); err != ErrKeyNotFound {
+		t.Error("Missing key should fail to swap", err)
+	}
+
+	deleted, err := table.CompareAndDelete(k, swapped.Version())
+	if err != nil || deleted != swapped || table.Exists(k) {
+		t.Error("Error deleting item", err)
+	}
+
+	// 并发的CAS只有一个成功
+	var wg sync.WaitGroup
+	var succeeded int64
+	version := second.Version()
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := table.CompareAndSwap("other", version, i); err == nil {
+				atomic.AddInt64(&succeeded, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if succeeded != 1 {
+		t.Error("Exactly one concurrent swap should succeed", succeeded)
+	}
+}
+
+// 测试计数器
+func TestCounter(t *testing.T) {
+	table := testCache(t, "testCounter")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			table.Incr(k, 2, time.Minute)
+			table.Decr(k, 1, time.Minute)
+			table.IncrFloat("float", 0.5, 0)
+		}()
+	}
+	wg.Wait()
+
+	if n, err := table.Incr(k, 0, 0); err != nil || n != 100 {
+		t.Error("Error incrementing counter", n, err)
+	}
+	if f, err := table.IncrFloat("float", 0, 0); err != nil || f != 50 {
+		t.Error("Error incrementing float counter", f, err)
+	}
+	if p, _ := table.Value(k); p.LifeSpan() != time.Minute {
+		t.Error("Counter should keep its lifeSpan", p.LifeSpan())
+	}
+
+	table.Add("string", 0, v)
+	if _, err := table.Incr("string", 1, 0); err != ErrNotCounter {
+		t.Error("Incrementing a non-counter should fail", err)
+	}
+	if _, err := table.IncrFloat(k, 1, 0); err != ErrNotCounter {
+		t.Error("Incrementing with the wrong type should fail", err)
+	}
+
+	// 不重置访问时间的计数器按时过期
+	for i := 0; i < 3; i++ {
+		table.Incr("window", 1, 100*time.Millisecond, CounterWithoutKeepAlive())
+		table.Incr("idle", 1, 100*time.Millisecond)
+		time.Sleep(40 * time.Millisecond)
+	}
+	if table.Exists("window") || !table.Exists("idle") {
+		t.Error("Counter without keep alive should expire")
+	}
+}
+
+// 测试批量增删
+func TestBulk(t *testing.T) {
+	table := testCache(t, "testBulk")
+
+	var m sync.Mutex
+	added, removed := 0, 0
+	table.AddAddedItemCallback(func(item *CacheItem) {
+		m.Lock()
+		defer m.Unlock()
+		added++
+	})
+	table.AddRemovalListener(func(item *CacheItem, cause RemovalCause) {
+		m.Lock()
+		defer m.Unlock()
+		removed++
+	})
+	errReject := errors.New("reject")
+	table.AddInterceptor(Interceptor{
+		Before: func(op *Op) error {
+			if op.Key == "rejected" {
+				return errReject
+			}
+			return nil
+		},
+	})
+
+	items := []*CacheItem{}
+	for i := 0; i < 100; i++ {
+		items = append(items, NewCacheItem(i, 100*time.Millisecond, i))
+	}
+	items = append(items, NewCacheItem("rejected", 0, v))
+	items = append(items, NewCacheItem(0, 0, "replaced"))
+
+	result, errs := table.AddMany(items)
+	if errs[100] != errReject || result[100] != nil || table.Exists("rejected") {
+		t.Error("Rejected item should not be added", errs[100])
+	}
+	if table.Count() != 100 || result[50].Data() != 50 || result[50].Version() == 0 {
+		t.Error("Error adding items", table.Count())
+	}
+	if p, _ := table.Value(0); p.Data() != "replaced" {
+		t.Error("Later items should replace earlier ones")
+	}
+
+	deleted, errs := table.DeleteMany([]interface{}{0, 1, "missing"})
+	if errs[0] != nil || deleted[0].Data() != "replaced" || deleted[1].Data() != 1 || errs[2] != ErrKeyNotFound {
+		t.Error("Error deleting items", errs)
+	}
+	if table.Count() != 98 {
+		t.Error("Error deleting items", table.Count())
+	}
+
+	// 所有条目一起过期
+	time.Sleep(200 * time.Millisecond)
+	if table.Count() != 0 {
+		t.Error("Items added in bulk should expire", table.Count())
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if added != 101 || removed != 101 {
+		t.Error("Error calling callbacks", added, removed)
+	}
+}
+
+// 测试批量写入和单个key的写入串行执行
+func TestBulkWriteThrough(t *testing.T) {
+	table := testCache(t, "testBulkWriteThrough")
+	store := newTestStore()
+	table.BindStore(store, StoreOptions{Mode: WriteThrough})
+
+	var concurrent sync.WaitGroup
+	interleave := func(key interface{}) {
+		if key != k {
+			return
+		}
+		store.onStore = nil
+		concurrent.Add(1)
+		go func() {
+			defer concurrent.Done()
+			table.Add(k, 0, "v2")
+		}()
+		// 等待并发的Add，加了key的锁时Add要等批量写入完成
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	store.onStore = interleave
+	table.AddMany([]*CacheItem{NewCacheItem(k, 0, "v1")})
+	concurrent.Wait()
+
+	p, err := table.Value(k)
+	data, _, _ := store.Load(k)
+	if err != nil || p.Data() != data {
+		t.Error("Cache and store should agree after AddMany", p.Data(), data)
+	}
+
+	store.onStore = interleave
+	table.AddMany([]*CacheItem{NewCacheItem(k, 0, "v1"), NewCacheItem(k + "_other", 0, v)})
+	concurrent.Wait()
+	if _, errs := table.DeleteMany([]interface{}{k, k + "_other"}); errs[0] != nil || errs[1] != nil {
+		t.Error("Error deleting items", errs)
+	}
+	if _, ok, _ := store.Load(k); ok || table.Exists(k) {
+		t.Error("Error deleting items from cache and store")
+	}
+}
+
+// 测试迭代器
+func TestIterators(t *testing.T) {
+	table := testCache(t, "testIterators")
+
+	for i := 0; i < 10; i++ {
+		table.Add(i, 0, i)
+	}
+
+	// 迭代期间可以增删条目
+	n := 0
+	for key, item := range table.All() {
+		if key != item.Key() {
+			t.Error("Error iterating items")
+		}
+		table.Delete(key)
+		table.Add(key.(int)+100, 0, v)
+		n++
+	}
+	if n != 10 || table.Count() != 10 || table.Exists(0) {
+		t.Error("Error mutating table during iteration", n, table.Count())
+	}
+
+	n = 0
+	for key := range table.Keys() {
+		if key.(int) < 100 {
+			t.Error("Error iterating keys", key)
+		}
+		n++
+		if n == 3 {
+			break
+		}
+	}
+	if n != 3 {
+		t.Error("Error breaking iteration", n)
+	}
+
+	for item := range table.Values() {
+		if item.Data() != v || item.AccessCount() != 0 {
+			t.Error("Error iterating values")
+		}
+	}
+
+	table.Foreach(func(key interface{}, item *CacheItem) {
+		table.Delete(key)
+	})
+	if table.Count() != 0 {
+		t.Error("Foreach should allow deleting items", table.Count())
+	}
+}
+
+// 测试游标分页遍历
+func TestScan(t *testing.T) {
+	table := testCache(t, "testScan")
+
+	for i := 0; i < 1000; i++ {
+		table.Add("stable:" + strconv.Itoa(i), 0, i)
+		table.Add("volatile:" + strconv.Itoa(i), 0, i)
+	}
+
+	// 遍历期间并发增删、替换条目
+	seen := map[interface{}]int{}
+	var cursor uint64
+	for round := 0; ; round++ {
+		keys, next, err := table.Scan(cursor, 100, "stable:*")
+		if err != nil {
+			t.Fatal("Error scanning", err)
+		}
+		for _, key := range keys {
+			seen[key]++
+		}
+
+		table.Delete("volatile:" + strconv.Itoa(round))
+		table.Add("new:" + strconv.Itoa(round), 0, round)
+		table.Add("stable:" + strconv.Itoa(round*7), 0, v)
+
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+
+	if len(seen) != 1000 {
+		t.Error("Every stable key should be returned", len(seen))
+	}
+	for key := range seen {
+		if !strings.HasPrefix(key.(string), "stable:") {
+			t.Error("Error matching keys", key)
+		}
+	}
+
+	if _, _, err := table.Scan(0, 10, "["); err == nil {
+		t.Error("Bad pattern should fail")
+	}
+}
+
+// 测试ValuesMany和AsyncTable经过拦截器
+func TestInterceptorValuesMany(t *testing.T) {
+	table := testCache(t, "testInterceptorValuesMany")
+
+	errDenied := errors.New("denied")
+	var afters int32
+	table.AddInterceptor(Interceptor{
+		Before: func(op *Op) error {
+			if op.Kind != OpValue {
+				return nil
+			}
+			if op.Key == "secret" {
+				return errDenied
+			}
+			if s, ok := op.Key.(string); ok {
+				op.Key = strings.ToLower(s)
+			}
+			return nil
+		},
+		After: func(op *Op, item *CacheItem, err error) {
+			if op.Kind == OpValue {
+				atomic.AddInt32(&afters, 1)
+			}
+		},
+	})
+
+	table.Add("a", 0, 1)
+	table.Add("secret", 0, 2)
+
+	r, err := table.ValuesMany([]interface{}{"A", "secret", "missing"})
+	if err != errDenied {
+		t.Error("Vetoed keys should return the error", err)
+	}
+	if len(r) != 1 || r["A"] == nil || r["A"].Key() != "a" {
+		t.Error("Error rewriting keys in ValuesMany", r)
+	}
+	if n := atomic.LoadInt32(&afters); n != 3 {
+		t.Error("Every key should call After", n)
+	}
+
+	async := NewAsyncTable(table, 1)
+	if item, err := async.Value("A").Get(); err != nil || item.Key() != "a" {
+		t.Error("Error rewriting keys in AsyncTable", err)
+	}
+	if _, err := async.Value("secret").Get(); err != errDenied {
+		t.Error("Error aborting async value", err)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&afters) != 5; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&afters); n != 5 {
+		t.Error("Async values should call After", n)
+	}
+}
+
+// 测试读改写操作经过拦截器
+func TestInterceptorCompute(t *testing.T) {
+	table := testCache(t, "testInterceptorCompute")
+	table.Add(k, 0, int64(1))
+
+	errReadOnly := errors.New("read only")
+	sub := table.AddInterceptor(Interceptor{
+		Before: func(op *Op) error {
+			if op.Kind == OpValue {
+				return nil
+			}
+			return errReadOnly
+		},
+	})
+
+	if item := table.Compute(k, 0, func(old *CacheItem) (interface{}, bool) {
+		return int64(2), true
+	}); item != nil {
+		t.Error("Vetoed compute should not write", item)
+	}
+	if _, err := table.Incr(k, 1, 0); err != errReadOnly {
+		t.Error("Vetoed incr should return the error", err)
+	}
+	if _, err := table.Update(k, func(old interface{}) (interface{}, bool) {
+		return nil, false
+	}); err != errReadOnly {
+		t.Error("Vetoed update should return the error", err)
+	}
+	if p, err := table.Value(k); err != nil || p.Data().(int64) != 1 {
+		t.Error("Vetoed operations should not change the item", err)
+	}
+	sub.Unsubscribe()
+
+	table.AddInterceptor(Interceptor{
+		Before: func(op *Op) error {
+			if op.Kind == OpAdd {
+				op.LifeSpan = time.Minute
+			}
+			return nil
+		},
+	})
+	if n, err := table.Incr(k, 1, 0); err != nil || n != 2 {
+		t.Error("Error incrementing through interceptor", n, err)
+	}
+	if p, err := table.Value(k); err != nil || p.LifeSpan() != time.Minute {
+		t.Error("Error rewriting compute operation", err)
+	}
+
+	table.AddInterceptor(Interceptor{
+		Before: func(op *Op) error {
+			op.Key = "other"
+			return nil
+		},
+	})
+	if _, err := table.Incr(k, 1, 0); err != ErrKeyRewritten {
+		t.Error("Rewriting the key of a compute should fail", err)
+	}
+}
+
+// 测试删除条目时清理游标遍历的索引
+func TestScanIndexCompaction(t *testing.T) {
+	table := testCache(t, "testScanIndexCompaction")
+
+	keys := make([]interface{}, 10000)
+	for i := range keys {
+		keys[i] = i
+		table.Add(i, 0, v)
+	}
+	for _, key := range keys[:5000] {
+		table.Delete(key)
+	}
+	table.DeleteMany(keys[5000:8000])
+	table.FlushWhere(func(key interface{}, item *CacheItem) bool {
+		return key.(int) < 9000
+	})
+	table.DeleteFunc(func(key interface{}, item *CacheItem) bool {
+		return key.(int) < 9500
+	})
+
+	table.RLock()
+	n := len(table.scanIndex)
+	table.RUnlock()
+	if table.Count() != 500 || n > 2*500 + 64 {
+		t.Error("Deleted items should be pruned from the scan index", table.Count(), n)
+	}
+}
@@ -35,16 +35,32 @@ type CacheItem struct {
 	accessedOn time.Time
 	// 条目被访问的次数
 	accessCount int64
+	// loadData加载该条目所用的时间，不是加载出来的条目等于0
+	computeTime time.Duration
+	// 加入表时分配的版本号，同一个表中单调递增，用于CompareAndSwap
+	version uint64
 
 	// 条目被移除时的回调函数组
 	// 元素是函数的切片
-	aboutToExpire []func(key interface{}) 
+	aboutToExpire []callbackEntry[func(key interface{})]
+	// 条目被移除时带条目和移除原因的回调函数组
+	removalListeners []callbackEntry[func(item *CacheItem, cause RemovalCause)]
 }
 
-// 创建条目
-func NewCacheItem(key interface{}, lifeSpan time.Duration, data interface{}) *CacheItem {
+// 添加条目时的选项
+type ItemOption func(item *CacheItem)
+
+// 添加条目时设置带移除原因的回调函数，同AddRemovalListener
+func WithRemovalListener(f func(item *CacheItem, cause RemovalCause)) ItemOption {
+	return func(item *CacheItem) {
+		item.removalListeners = append(item.removalListeners, newCallbackEntry(f))
+	}
+}
+
+// 创建条目，opts可以给条目设置移除的回调函数等选项
+func NewCacheItem(key interface{}, lifeSpan time.Duration, data interface{}, opts ...ItemOption) *CacheItem {
 	t := time.Now()
-	return &CacheItem {
+	item := &CacheItem {
 		key: key,
 		data: data,
 		lifeSpan: lifeSpan,
@@ -53,6 +69,7 @@ func NewCacheItem(key interface{}, lifeSpan time.Duration, data interface{}) *Ca
 		accessCount: 0,
 		aboutToExpire: nil,
 	}
+	return item.apply(opts)
 }
 
 // 重置被访问的时间，保活，避免被移除
@@ -63,6 +80,22 @@ func (item *CacheItem) KeepAlive() {
 	item.accessCount++
 }
 
+// 返回条目的快照，不包含回调函数
+func (item *CacheItem) snapshot() *CacheItem {
+	item.RLock()
+	defer item.RUnlock()
+	return &CacheItem{
+		key: item.key,
+		data: item.data,
+		lifeSpan: item.lifeSpan,
+		createdOn: item.createdOn,
+		accessedOn: item.accessedOn,
+		accessCount: item.accessCount,
+		computeTime: item.computeTime,
+		version: item.version,
+	}
+}
+
 // 返回没有访问后的保活时间
 func (item *CacheItem) LifeSpan() time.Duration {
 	// 不需要加锁，因为创建后就没有情况会修改此值
@@ -89,6 +122,18 @@ func (item *CacheItem) AccessCount() int64 {
 	return item.accessCount
 }
 
+// 返回loadData加载该条目所用的时间
+func (item *CacheItem) ComputeTime() time.Duration {
+	// 不需要加锁，因为加入表后就没有情况会修改此值
+	return item.computeTime
+}
+
+// 返回条目的版本号，没有加入表中时等于0
+func (item *CacheItem) Version() uint64 {
+	// 不需要加锁，因为加入表后就没有情况会修改此值
+	return item.version
+}
+
 // 返回条目key
 func (item *CacheItem) Key() interface{} {
 	// 不需要加锁，因为创建后就没有情况会修改此值
@@ -108,14 +153,22 @@ func (item *CacheItem) SetAboutToExpireCallback(f func(interface{})) {
 	}
 	item.Lock()
 	defer item.Unlock()
-	item.aboutToExpire = append(item.aboutToExpire, f)
+	item.aboutToExpire = append(item.aboutToExpire, newCallbackEntry(f))
 }
 
-// 添加被移除时候的回调函数
-func (item *CacheItem) AddAboutToExpireCallback(f func(interface{})) {
+// 添加被移除时候的回调函数，返回的订阅可以单独删除该回调函数
+func (item *CacheItem) AddAboutToExpireCallback(f func(interface{})) *Subscription {
 	item.Lock()
 	defer item.Unlock()
-	item.aboutToExpire = append(item.aboutToExpire, f)
+
+	e := newCallbackEntry(f)
+	item.aboutToExpire = append(item.aboutToExpire, e)
+
+	return newSubscription(func() {
+		item.Lock()
+		defer item.Unlock()
+		item.aboutToExpire = removeCallback(item.aboutToExpire, e.id)
+	})
 }
 
 // 删除被移除时候的回调函数
@@ -123,4 +176,44 @@ func (item *CacheItem) RemoveAboutToExpireCallback() {
 	item.Lock()
 	defer item.Unlock()
 	item.aboutToExpire = nil
+}
+
+// 添加被移除时带条目和移除原因的回调函数，包括被相同key的新条目替换
+// 返回的订阅可以单独删除该回调函数
+func (item *CacheItem) AddRemovalListener(f func(item *CacheItem, cause RemovalCause)) *Subscription {
+	item.Lock()
+	defer item.Unlock()
+
+	e := newCallbackEntry(f)
+	item.removalListeners = append(item.removalListeners, e)
+
+	return newSubscription(func() {
+		item.Lock()
+		defer item.Unlock()
+		item.removalListeners = removeCallback(item.removalListeners, e.id)
+	})
+}
+
+// 删除所有带移除原因的回调函数
+func (item *CacheItem) RemoveRemovalListeners() {
+	item.Lock()
+	defer item.Unlock()
+	item.removalListeners = nil
+}
+
+// 从src复制回调函数，加载函数返回的条目会被重新创建，不能丢掉它上面的回调函数
+func (item *CacheItem) callbacksFrom(src *CacheItem) *CacheItem {
+	src.RLock()
+	defer src.RUnlock()
+	item.aboutToExpire = src.aboutToExpire
+	item.removalListeners = src.removalListeners
+	return item
+}
+
+// 应用添加条目时的选项
+func (item *CacheItem) apply(opts []ItemOption) *CacheItem {
+	for _, opt := range opts {
+		opt(item)
+	}
+	return item
 }
\ No newline at end of file
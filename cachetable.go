@@ -10,9 +10,13 @@
 package cache2go
 
 import (
+	"fmt"
 	"log"
+	"math"
+	"math/rand"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,6 +29,19 @@ type CacheTable struct {
 	name string
 	// 该表项存储的所有条目
 	items map[interface{}]*CacheItem
+	// loadData确认不存在的key，key<->负缓存的过期时间
+	// 不计入Count，也不会被Foreach遍历
+	negatives map[interface{}]time.Time
+	// 负缓存的保活时间，等于0说明不启用负缓存
+	negativeLifeSpan time.Duration
+
+	// 提前刷新的阈值，条目写入后经过 lifeSpan*refreshThreshold 再被访问
+	// 就异步调用loadData重新加载，等于0说明不启用
+	refreshThreshold float64
+	// 正在异步刷新的key，保证同一个key同时只有一个刷新
+	refreshing map[interface{}]bool
+	// XFetch提前过期的beta参数，越大越倾向于提前刷新，等于0说明不启用
+	xfetchBeta float64
 
 	// 负责触发清除操作的计时器
 	cleanupTimer *time.Timer
@@ -36,11 +53,52 @@ type CacheTable struct {
 
 	// 加载一个不存在的key时触发的回调函数，args可变长函数参数
 	// 返回非nil，则加入到表中
-	loadData func(key interface{}, args ...interface{}) *CacheItem
+	loadData LoaderFunc
+	// 加载函数路由，按顺序匹配，优先于loadData
+	loaderRoutes []loaderRoute
+	// 加载策略
+	loaderPolicy LoaderPolicy
+	// 限制同时进行的加载个数，nil说明不限制
+	loaderSem chan struct{}
+	// 熔断器，nil说明不启用
+	breaker *breaker
+	// ServeStale时每个key最后一次加载到的条目
+	stale map[interface{}]*CacheItem
+	// 加载成功和失败的次数
+	loadSuccesses int64
+	loadFailures int64
+	// 绑定的持久化存储，nil说明没有绑定
+	store *boundStore
+	// 批量加载函数，一次加载多个不存在的key
+	batchLoader BatchLoader
+	// 合并Value未命中的key的窗口时间，等于0说明不合并
+	batchWindow time.Duration
+	// 一个批次最多的key个数，等于0说明不限制
+	batchMaxSize int
+	// 正在合并窗口中等待加载的批次
+	pendingBatch *batch
 	// 添加缓存条目时触发的回调函数组
-	addedItem []func(item *CacheItem)
+	addedItem []callbackEntry[func(item *CacheItem)]
 	// 删除缓存条目时触发的回调函数组
-	aboutToDeleteItem []func(item *CacheItem)
+	aboutToDeleteItem []callbackEntry[func(item *CacheItem)]
+	// 移除缓存条目时触发的回调函数组，带有移除原因
+	removalListeners []callbackEntry[func(item *CacheItem, cause RemovalCause)]
+	// 异步分发回调函数，nil说明同步调用
+	dispatcher *dispatcher
+	// 回调函数或者加载函数panic、写入存储失败时触发的回调函数
+	onError func(err error)
+	// 事件流的订阅者
+	streams []callbackEntry[*EventStream]
+	// 拦截器
+	interceptors []callbackEntry[Interceptor]
+	// 正在读改写的key的锁
+	keyLocks map[interface{}]*keyLock
+	// 最近一次分配给条目的版本号
+	version uint64
+	// 正在加载的key<->Future，同一个key的加载共享结果
+	inflight map[interface{}]*Future
+	// 按版本号递增排列的条目，用于Scan
+	scanIndex []*CacheItem
 }
 
 // 返回该表项拥有的条目个数
@@ -50,12 +108,54 @@ func (table *CacheTable) Count() int {
 	return len(table.items)
 }
 
-// 遍历缓存条目，触发回调函数
-func (table *CacheTable) Foreach(trans func(key interface{}, item *CacheItem)) {
+// 缓存表的统计信息
+type TableStats struct {
+	// 条目个数
+	Items int
+	// 负缓存条目个数
+	NegativeItems int
+	// 加载成功的次数，包括批量加载
+	LoadSuccesses int64
+	// 加载失败的次数，包括超时，重试只记一次
+	LoadFailures int64
+	// 熔断器状态，没有启用熔断时是BreakerClosed
+	BreakerState BreakerState
+	// 异步分发时因为队列满了被丢弃的回调个数
+	DroppedCallbacks int64
+}
+
+// 返回该表项的统计信息
+func (table *CacheTable) Stats() TableStats {
 	table.RLock()
 	defer table.RUnlock()
 
-	for k, v := range table.items {
+	stats := TableStats{
+		Items: len(table.items),
+		NegativeItems: len(table.negatives),
+		LoadSuccesses: atomic.LoadInt64(&table.loadSuccesses),
+		LoadFailures: atomic.LoadInt64(&table.loadFailures),
+	}
+	if table.breaker != nil {
+		stats.BreakerState = table.breaker.State()
+	}
+	if table.dispatcher != nil {
+		stats.DroppedCallbacks = table.dispatcher.Dropped()
+	}
+
+	return stats
+}
+
+// 返回该表项拥有的负缓存条目个数
+func (table *CacheTable) NegativeCount() int {
+	table.RLock()
+	defer table.RUnlock()
+	return len(table.negatives)
+}
+
+// 遍历缓存条目，触发回调函数
+// 遍历的是快照，trans中可以增删该表的条目，需要提前结束时使用All
+func (table *CacheTable) Foreach(trans func(key interface{}, item *CacheItem)) {
+	for k, v := range table.All() {
 		trans(k, v)
 	}
 }
@@ -65,7 +165,39 @@ func (table *CacheTable) Foreach(trans func(key interface{}, item *CacheItem)) {
 func (table *CacheTable) SetDataLoader(f func(interface{}, ...interface{}) *CacheItem) {
 	table.Lock()
 	defer table.Unlock()
-	table.loadData = f
+
+	if f == nil {
+		table.loadData = nil
+		return
+	}
+
+	table.loadData = func(key interface{}, args ...interface{}) (*CacheItem, error) {
+		return f(key, args...), nil
+	}
+}
+
+// 设置负缓存的保活时间，loadData返回nil的key在这段时间内
+// 直接返回ErrKeyNotFound，不会再次调用loadData，等于0说明不启用
+func (table *CacheTable) SetNegativeLifeSpan(lifeSpan time.Duration) {
+	table.Lock()
+	defer table.Unlock()
+	table.negativeLifeSpan = lifeSpan
+}
+
+// 设置提前刷新的阈值，取值(0, 1)，例如0.8表示条目写入后经过80%的
+// 保活时间再被访问，就异步重新加载，加载完成前继续返回当前条目
+func (table *CacheTable) SetRefreshThreshold(threshold float64) {
+	table.Lock()
+	defer table.Unlock()
+	table.refreshThreshold = threshold
+}
+
+// 设置XFetch概率提前过期的beta参数，通常取1，等于0说明不启用
+// 每次访问根据loadData的耗时和剩余的保活时间决定是否异步刷新
+func (table *CacheTable) SetXFetchBeta(beta float64) {
+	table.Lock()
+	defer table.Unlock()
+	table.xfetchBeta = beta
 }
 
 // 设置添加缓存条目时触发的回调函数，会删除以前的回调函数
@@ -75,14 +207,22 @@ func (table *CacheTable) SetAddedItemCallback(f func(*CacheItem)) {
 	}
 	table.Lock()
 	defer table.Unlock()
-	table.addedItem = append(table.addedItem, f)
+	table.addedItem = append(table.addedItem, newCallbackEntry(f))
 }
 
-// 添加缓存条目时触发的回调函数
-func (table *CacheTable) AddAddedItemCallback(f func(*CacheItem)) {
+// 添加缓存条目时触发的回调函数，返回的订阅可以单独删除该回调函数
+func (table *CacheTable) AddAddedItemCallback(f func(*CacheItem)) *Subscription {
 	table.Lock()
 	defer table.Unlock()
-	table.addedItem = append(table.addedItem, f)
+
+	e := newCallbackEntry(f)
+	table.addedItem = append(table.addedItem, e)
+
+	return newSubscription(func() {
+		table.Lock()
+		defer table.Unlock()
+		table.addedItem = removeCallback(table.addedItem, e.id)
+	})
 }
 
 // 删除添加缓存条目时触发的回调函数
@@ -100,14 +240,22 @@ func (table *CacheTable) SetAboutToDeleteItemCallback(f func(*CacheItem)) {
 
 	table.Lock()
 	defer table.Unlock()
-	table.aboutToDeleteItem = append(table.aboutToDeleteItem, f)
+	table.aboutToDeleteItem = append(table.aboutToDeleteItem, newCallbackEntry(f))
 }
 
-// 添加删除缓存条目时触发的回调函数
-func (table *CacheTable) AddAboutToDeleteItemCallback(f func(*CacheItem)) {
+// 添加删除缓存条目时触发的回调函数，返回的订阅可以单独删除该回调函数
+func (table *CacheTable) AddAboutToDeleteItemCallback(f func(*CacheItem)) *Subscription {
 	table.Lock()
 	defer table.Unlock()
-	table.aboutToDeleteItem = append(table.aboutToDeleteItem, f)
+
+	e := newCallbackEntry(f)
+	table.aboutToDeleteItem = append(table.aboutToDeleteItem, e)
+
+	return newSubscription(func() {
+		table.Lock()
+		defer table.Unlock()
+		table.aboutToDeleteItem = removeCallback(table.aboutToDeleteItem, e.id)
+	})
 }
 
 // 删除缓存条目时触发的回调函数
@@ -117,6 +265,37 @@ func (table *CacheTable) RemoveAboutToDeleteItemCallback() {
 	table.aboutToDeleteItem = nil
 }
 
+// 添加移除缓存条目时触发的回调函数，可以通过cause区分移除的原因
+// 返回的订阅可以单独删除该回调函数
+func (table *CacheTable) AddRemovalListener(f func(item *CacheItem, cause RemovalCause)) *Subscription {
+	table.Lock()
+	defer table.Unlock()
+
+	e := newCallbackEntry(f)
+	table.removalListeners = append(table.removalListeners, e)
+
+	return newSubscription(func() {
+		table.Lock()
+		defer table.Unlock()
+		table.removalListeners = removeCallback(table.removalListeners, e.id)
+	})
+}
+
+// 删除移除缓存条目时触发的回调函数
+func (table *CacheTable) RemoveRemovalListeners() {
+	table.Lock()
+	defer table.Unlock()
+	table.removalListeners = nil
+}
+
+// 设置出错时触发的回调函数
+// 回调函数和加载函数的panic会被恢复，转换成错误交给该函数，同时记录日志
+func (table *CacheTable) SetOnError(f func(err error)) {
+	table.Lock()
+	defer table.Unlock()
+	table.onError = f
+}
+
 // 设置日志
 func (table *CacheTable) SetLogger(logger *log.Logger) {
 	table.Lock()
@@ -167,7 +346,7 @@ func (table *CacheTable) expirationCheck() {
 			table.Unlock()
 			
 			// 内部删除接口
-			table.deleteInternal(key)
+			table.deleteInternal(key, RemovalExpired)
 
 			table.Lock()
 		} else {
@@ -178,6 +357,19 @@ func (table *CacheTable) expirationCheck() {
 		}
 	}
 
+	// 负缓存条目以创建时间计算过期，访问不会保活
+	for key, expireOn := range table.negatives {
+		if !now.Before(expireOn) {
+			table.log("Deleting negative item with key", key, "from table", table.name)
+			delete(table.negatives, key)
+			continue
+		}
+
+		if smallestDuration == 0 || expireOn.Sub(now) < smallestDuration {
+			smallestDuration = expireOn.Sub(now)
+		}
+	}
+
 	// 设置cleanupInterval为最近将要过期的时间间隔
 	table.cleanupInterval = smallestDuration
 	if smallestDuration > 0 {
@@ -191,12 +383,9 @@ func (table *CacheTable) expirationCheck() {
 }
 
 // 内部添加函数，代码重用
-func (table *CacheTable) addInternal(item *CacheItem) {
-	table.log("Adding item with key", item.key, 
-		"and lifeSpan of", item.lifeSpan, 
-		"to table", table.name)
-
-	table.items[item.key] = item
+// 替换了相同key的条目时返回被替换的条目
+func (table *CacheTable) addInternal(item *CacheItem) *CacheItem {
+	old := table.install(item)
 
 	// 表 触发清除操作的时间间隔
 	expDur := table.cleanupInterval
@@ -205,12 +394,7 @@ func (table *CacheTable) addInternal(item *CacheItem) {
 
 	table.Unlock()
 
-	// 存在回掉函数就call
-	if addedItem != nil {
-		for _, callback := range addedItem {
-			callback(item)
-		}
-	}
+	table.notifyAdded(item, old, addedItem)
 
 	// 如果当前过期检测时间等于0 或者 
 	// 当前添加条目的保活时间 比当前 最短的过期时间还早过期，
@@ -221,67 +405,231 @@ func (table *CacheTable) addInternal(item *CacheItem) {
 	if item.lifeSpan > 0 && (expDur == 0 || item.lifeSpan < expDur) {
 		table.expirationCheck()
 	}
+
+	return old
+}
+
+// 把条目放入表中，调用时需要持有表的锁，返回被替换的条目
+func (table *CacheTable) install(item *CacheItem) *CacheItem {
+	table.log("Adding item with key", item.key, 
+		"and lifeSpan of", item.lifeSpan, 
+		"to table", table.name)
+
+	table.version++
+	item.version = table.version
+
+	old := table.items[item.key]
+	table.items[item.key] = item
+	// 真正加入的条目覆盖负缓存
+	delete(table.negatives, item.key)
+	table.indexItem(item)
+
+	return old
+}
+
+// 触发加入条目的回调函数，调用时不能持有表的锁
+func (table *CacheTable) notifyAdded(item *CacheItem, old *CacheItem, addedItem []callbackEntry[func(item *CacheItem)]) {
+	// 被替换的条目触发移除的回调函数，方便释放旧条目引用的资源
+	if old != nil {
+		table.notifyRemoval(old, RemovalReplaced)
+		table.publish(EventUpdated, item, RemovalReplaced)
+	} else {
+		table.publish(EventAdded, item, RemovalExplicit)
+	}
+
+	// 存在回掉函数就call
+	if len(addedItem) > 0 {
+		table.dispatch(item.key, func() {
+			for _, callback := range addedItem {
+				table.safeCall(func() { callback.f(item) })
+			}
+		})
+	}
 }
 
 // 创建缓存条目并且加入到缓存表
 // 存在相同条目被前后增加的情况，不会并发增加
-func (table *CacheTable) Add(key interface{}, lifeSpan time.Duration, data interface{}) *CacheItem {
-	// 创建条目
-	item := NewCacheItem(key, lifeSpan, data)
-
-	table.Lock()
-	// 内部添加接口
-	table.addInternal(item)
+// 被拦截器中止时返回nil，错误交给onError，需要错误时使用TryAdd
+// opts可以给条目设置移除的回调函数等选项
+func (table *CacheTable) Add(key interface{}, lifeSpan time.Duration, data interface{}, opts ...ItemOption) *CacheItem {
+	item, err := table.TryAdd(key, lifeSpan, data, opts...)
+	if err != nil {
+		table.reportError(err)
+	}
 
 	return item
 }
 
+// 同Add，返回拦截器中止添加的错误，和WriteThrough写入存储失败的错误
+// 写入存储失败时不会加入缓存
+func (table *CacheTable) TryAdd(key interface{}, lifeSpan time.Duration, data interface{}, opts ...ItemOption) (*CacheItem, error) {
+	op := &Op{Kind: OpAdd, Key: key, Data: data, LifeSpan: lifeSpan}
+
+	return table.intercept(op, func(op *Op) (*CacheItem, error) {
+		return table.storeFirst(op.Key, op.Data, false, nil, func() (*CacheItem, error) {
+			// 创建条目
+			item := NewCacheItem(op.Key, op.LifeSpan, op.Data, opts...)
+
+			table.Lock()
+			// 内部添加接口
+			table.addInternal(item)
+
+			return item, nil
+		})
+	})
+}
+
 // 内部删除函数，代码重用
 // 存在一个 删除表中条目或条目被删除的回调函数 被多次调用的
 // 情况，但是不会多次删除同一条目
-func (table *CacheTable) deleteInternal(key interface{}) (*CacheItem, error) {
+func (table *CacheTable) deleteInternal(key interface{}, cause RemovalCause) (*CacheItem, error) {
 	table.Lock()
 
+	// 过期的条目保留给ServeStale使用
+	if cause != RemovalExpired {
+		delete(table.stale, key)
+	}
+
 	r, ok := table.items[key]
-	if !ok { 
+	if !ok {
+		// 删除负缓存，下次访问会重新调用loadData
+		delete(table.negatives, key)
+		table.Unlock()
 		return nil, ErrKeyNotFound
 	}
 
-	aboutToDeleteItem := table.aboutToDeleteItem
-
 	table.Unlock()
 
-	// 触发删条目的回调函数
-	if aboutToDeleteItem != nil {
-		for _, callback := range aboutToDeleteItem {
-			callback(r)
-		}
-	}
-
-	// 触发条目过期删除的回调函数
-	r.RLock()
-	defer r.RUnlock()
-	if r.aboutToExpire != nil {
-		for _, callback := range r.aboutToExpire {
-			callback(key)
-		}
-	}
+	table.notifyRemoval(r, cause)
 
 	table.Lock()
 
 	table.log("Deleting item with key", key, 
 		"created on", r.createdOn, "and hit", 
 		r.accessCount, "times from table", table.name)
-	delete(table.items, key)
+	// 回调期间可能被新的条目替换了，不能删除新的条目
+	if table.items[key] == r {
+		delete(table.items, key)
+		table.compactScanIndex()
+	}
 	
 	table.Unlock()
 	
 	return r, nil
 }
 
+// 替换已经存在的key，返回被替换的条目
+// 被替换的条目会以RemovalReplaced触发移除的回调函数，key不存在时返回ErrKeyNotFound
+// WriteThrough写入存储失败时返回存储的错误，不会替换
+func (table *CacheTable) Replace(key interface{}, lifeSpan time.Duration, data interface{}, opts ...ItemOption) (*CacheItem, error) {
+	var old *CacheItem
+	op := &Op{Kind: OpAdd, Key: key, Data: data, LifeSpan: lifeSpan}
+
+	_, err := table.intercept(op, func(op *Op) (*CacheItem, error) {
+		check := func() error {
+			if !table.Exists(op.Key) {
+				return ErrKeyNotFound
+			}
+			return nil
+		}
+
+		return table.storeFirst(op.Key, op.Data, false, check, func() (*CacheItem, error) {
+			table.Lock()
+
+			if _, ok := table.items[op.Key]; !ok {
+				table.Unlock()
+				return nil, ErrKeyNotFound
+			}
+
+			item := NewCacheItem(op.Key, op.LifeSpan, op.Data, opts...)
+			old = table.addInternal(item)
+
+			return item, nil
+		})
+	})
+
+	return old, err
+}
+
+// 添加或者替换条目，返回新的条目和被替换的条目，key不存在时old为nil
+// 被替换的条目会以RemovalReplaced触发移除的回调函数
+// 被拦截器中止或者写入存储失败时都返回nil，错误交给onError
+func (table *CacheTable) AddOrUpdate(key interface{}, lifeSpan time.Duration, data interface{}, opts ...ItemOption) (item *CacheItem, old *CacheItem) {
+	op := &Op{Kind: OpAdd, Key: key, Data: data, LifeSpan: lifeSpan}
+
+	item, err := table.intercept(op, func(op *Op) (*CacheItem, error) {
+		return table.storeFirst(op.Key, op.Data, false, nil, func() (*CacheItem, error) {
+			item := NewCacheItem(op.Key, op.LifeSpan, op.Data, opts...)
+
+			table.Lock()
+			old = table.addInternal(item)
+
+			return item, nil
+		})
+	})
+	if err != nil {
+		table.reportError(err)
+	}
+
+	return item, old
+}
+
+// 触发条目被移除的回调函数，调用时不能持有表的锁
+// 依次触发表的aboutToDeleteItem、带移除原因的回调函数、条目带移除原因的回调函数、条目的aboutToExpire
+// 被替换的条目并没有从表中删除，不会触发表的aboutToDeleteItem
+func (table *CacheTable) notifyRemoval(r *CacheItem, cause RemovalCause) {
+	table.RLock()
+	aboutToDeleteItem := table.aboutToDeleteItem
+	removalListeners := table.removalListeners
+	table.RUnlock()
+
+	r.RLock()
+	aboutToExpire := r.aboutToExpire
+	itemListeners := r.removalListeners
+	r.RUnlock()
+
+	if cause != RemovalReplaced {
+		table.publish(EventRemoved, r, cause)
+	} else {
+		aboutToDeleteItem = nil
+	}
+
+	// 没有回调函数时不需要分发，避免占用分发队列
+	if len(aboutToDeleteItem) == 0 && len(removalListeners) == 0 &&
+		len(itemListeners) == 0 && len(aboutToExpire) == 0 {
+		return
+	}
+
+	table.dispatch(r.key, func() {
+		// 触发删条目的回调函数
+		for _, callback := range aboutToDeleteItem {
+			table.safeCall(func() { callback.f(r) })
+		}
+
+		// 触发带移除原因的回调函数
+		for _, listener := range removalListeners {
+			table.safeCall(func() { listener.f(r, cause) })
+		}
+		for _, listener := range itemListeners {
+			table.safeCall(func() { listener.f(r, cause) })
+		}
+
+		// 触发条目过期删除的回调函数
+		for _, callback := range aboutToExpire {
+			table.safeCall(func() { callback.f(r.key) })
+		}
+	})
+}
+
 // 从缓存表中删除缓存条目
+// 绑定了存储时，不管缓存中是否存在都会从存储中删除
+// WriteThrough从存储删除失败时返回存储的错误，不会从缓存中删除
 func (table *CacheTable) Delete(key interface{}) (*CacheItem, error) {
-	return table.deleteInternal(key)
+	return table.intercept(&Op{Kind: OpDelete, Key: key}, func(op *Op) (*CacheItem, error) {
+		return table.storeFirst(op.Key, nil, true, nil, func() (*CacheItem, error) {
+			return table.deleteInternal(op.Key, RemovalExplicit)
+		})
+	})
 }
 
 // 是否存在某个key
@@ -294,67 +642,478 @@ func (table *CacheTable) Exists(key interface{}) bool {
 }
 
 // 不存key就添加
-func (table *CacheTable) NotFoundAdd(key interface{}, lifeSpan time.Duration, data interface{}) bool {
-	table.Lock()
+func (table *CacheTable) NotFoundAdd(key interface{}, lifeSpan time.Duration, data interface{}, opts ...ItemOption) bool {
+	op := &Op{Kind: OpAdd, Key: key, Data: data, LifeSpan: lifeSpan}
 
-	if _, ok := table.items[key]; ok {
-		table.Unlock()
-		return false
-	}
+	item, err := table.intercept(op, func(op *Op) (*CacheItem, error) {
+		check := func() error {
+			if table.Exists(op.Key) {
+				return ErrKeyExists
+			}
+			return nil
+		}
 
-	// table.Unlock()，这里不应该解锁，
-	// 增加完成后才可以解锁
+		return table.storeFirst(op.Key, op.Data, false, check, func() (*CacheItem, error) {
+			table.Lock()
 
-	item := NewCacheItem(key, lifeSpan, data)
-	table.addInternal(item)
+			if _, ok := table.items[op.Key]; ok {
+				table.Unlock()
+				return nil, ErrKeyExists
+			}
+
+			// table.Unlock()，这里不应该解锁，
+			// 增加完成后才可以解锁
+
+			item := NewCacheItem(op.Key, op.LifeSpan, op.Data, opts...)
+			table.addInternal(item)
 
-	return true
+			return item, nil
+		})
+	})
+	if err != nil && err != ErrKeyExists {
+		table.reportError(err)
+	}
+
+	return item != nil
 }
 
 // 获取value, 会通过KeepAlive更新访问时间和访问次数
 func (table *CacheTable) Value(key interface{}, args ...interface{}) (*CacheItem, error) {
+	return table.intercept(&Op{Kind: OpValue, Key: key}, func(op *Op) (*CacheItem, error) {
+		return table.value(op.Key, args...)
+	})
+}
+
+// 获取value的实现
+func (table *CacheTable) value(key interface{}, args ...interface{}) (*CacheItem, error) {
 	table.RLock()
 
 	r, ok := table.items[key]
-	loadData := table.loadData
+	expireOn, negative := table.negatives[key]
+	refreshThreshold := table.refreshThreshold
+	xfetchBeta := table.xfetchBeta
+	batching := table.batchLoader != nil && table.batchWindow > 0
 
 	table.RUnlock()
 
+	loadData, routed, err := table.loaderFor(key)
+	batching = batching && !routed
+
 	if ok {
-		r.KeepAlive()
+		table.hit(r)
+
+		// 选择加载函数失败时不提前刷新，仍然返回命中的条目
+		if err == nil && loadData != nil && shouldRefresh(r, refreshThreshold, xfetchBeta) {
+			table.refresh(r, loadData, args...)
+		}
+
 		return r, nil
 	}
 
+	if err != nil {
+		return nil, err
+	}
+
+	// 负缓存没有过期，或者没有加载函数，不需要加载
+	if (negative && time.Now().Before(expireOn)) || (loadData == nil && !batching) {
+		return nil, ErrKeyNotFound
+	}
+
+	return table.loadShared(key, args...)
+}
+
+// 加载不存在的key，同一个key正在加载时等待加载的结果，包括AsyncTable发起的加载
+func (table *CacheTable) loadShared(key interface{}, args ...interface{}) (*CacheItem, error) {
+	f, leader := table.joinLoad(key)
+	if !leader {
+		return f.Get()
+	}
+
+	item, err := table.load(key, args...)
+	table.finishLoad(key, f, item, err)
+
+	return item, err
+}
+
+// 加载不存在的key，调用前需要通过joinLoad成为该key的加载者
+func (table *CacheTable) load(key interface{}, args ...interface{}) (*CacheItem, error) {
+	table.RLock()
+
+	r, ok := table.items[key]
+	expireOn, negative := table.negatives[key]
+	batching := table.batchLoader != nil && table.batchWindow > 0
+
+	table.RUnlock()
+
+	// 等待加载期间已经被加入了
+	if ok {
+		return r, nil
+	}
+
+	loadData, routed, err := table.loaderFor(key)
+	if err != nil {
+		return nil, err
+	}
+	batching = batching && !routed
+
+	// 负缓存没有过期，不再调用loadData
+	if negative && time.Now().Before(expireOn) {
+		return nil, ErrKeyNotFound
+	}
+
+	// 条目不存在，合并到批次中批量加载
+	if batching {
+		return table.batchValue(key)
+	}
+
 	// 条目不存在
 	if loadData != nil {
 		// 打散slice
-		item := loadData(key, args...)
-		if item != nil {
-			// 如果该key不存在，并发会造成相同的key多次被加入表中，
-			// 从而造成key对应的内容被覆盖，应该调用
-			// table.NotFoundAdd(key, item.lifeSpan, item.data)
-			table.Add(key, item.lifeSpan, item.data)
-			return item, nil
+		return table.loadAndAdd(key, loadData, args...)
+	}
+
+	return nil, ErrKeyNotFound
+}
+
+// 加入key正在进行的加载，没有正在进行的加载时创建Future并成为加载者
+// 第二个返回值说明是否是加载者，加载者加载完成后需要调用finishLoad
+func (table *CacheTable) joinLoad(key interface{}) (*Future, bool) {
+	table.Lock()
+	defer table.Unlock()
+
+	if f, ok := table.inflight[key]; ok {
+		return f, false
+	}
+
+	f := newFuture()
+	table.inflight[key] = f
+
+	return f, true
+}
+
+// 完成加载，等待的调用者都会得到同样的结果
+func (table *CacheTable) finishLoad(key interface{}, f *Future, item *CacheItem, err error) {
+	table.Lock()
+	delete(table.inflight, key)
+	table.Unlock()
+
+	f.complete(item, err)
+}
+
+// 返回正在加载的key个数
+func (table *CacheTable) Inflight() int {
+	table.RLock()
+	defer table.RUnlock()
+	return len(table.inflight)
+}
+
+// 命中条目，更新访问时间和访问次数
+func (table *CacheTable) hit(item *CacheItem) {
+	item.KeepAlive()
+	table.publish(EventAccessed, item, RemovalExplicit)
+}
+
+// 调用loadData加载条目并加入表中
+// loadData确认key不存在时加入负缓存
+func (table *CacheTable) loadAndAdd(key interface{}, loadData LoaderFunc, args ...interface{}) (*CacheItem, error) {
+	item, err := table.loadItem(key, loadData, args...)
+	if err != nil {
+		if stale := table.staleItem(key, err); stale != nil {
+			return stale, nil
 		}
+		return nil, err
+	}
 
+	if item == nil {
+		table.forgetStale(key)
+		table.addNegative(key)
 		return nil, ErrKeyNotFoundOrLoadable
 	}
 
-	return nil, ErrKeyNotFound
+	// 如果该key不存在，并发会造成相同的key多次被加入表中，
+	// 从而造成key对应的内容被覆盖，应该调用
+	// table.NotFoundAdd(key, item.lifeSpan, item.data)
+	added, err := table.addLoaded(item)
+	if err == nil {
+		table.keepStale(key, added)
+	}
+
+	return added, err
 }
 
-// 清除所有的缓存条目，不会调用 缓存表的aboutToDeleteItem 和 缓存条目的aboutToExpire 
-func (table *CacheTable) Flush() {
+// 删除key最后一次加载到的条目，key已经不存在或者被删除了
+func (table *CacheTable) forgetStale(key interface{}) {
+	table.Lock()
+	delete(table.stale, key)
+	table.Unlock()
+}
+
+// 按加载策略调用loadData，记录加载所用的时间
+// 返回新创建的条目，没有加入表中
+func (table *CacheTable) loadItem(key interface{}, loadData LoaderFunc, args ...interface{}) (*CacheItem, error) {
+	start := time.Now()
+	r, err := table.guard(func() (interface{}, error) {
+		return loadData(key, args...)
+	})
+	loaded, _ := r.(*CacheItem)
+	if err != nil || loaded == nil {
+		return nil, err
+	}
+
+	item := NewCacheItem(key, loaded.lifeSpan, loaded.data).callbacksFrom(loaded)
+	item.computeTime = time.Since(start)
+
+	return item, nil
+}
+
+// 是否需要提前刷新条目，都以写入时间计算
+// 超过阈值，或者XFetch认为需要提前过期，就返回true
+func shouldRefresh(item *CacheItem, threshold float64, beta float64) bool {
+	if item.lifeSpan <= 0 {
+		return false
+	}
+
+	age := time.Since(item.createdOn)
+	if threshold > 0 && age >= time.Duration(float64(item.lifeSpan)*threshold) {
+		return true
+	}
+
+	// XFetch: now - computeTime * beta * ln(rand) >= expiry
+	// rand取(0, 1]，避免ln(0)
+	if beta > 0 {
+		early := -float64(item.computeTime) * beta * math.Log(1-rand.Float64())
+		return age+time.Duration(early) >= item.lifeSpan
+	}
+
+	return false
+}
+
+// 异步重新加载条目，加载期间继续返回当前条目
+func (table *CacheTable) refresh(r *CacheItem, loadData LoaderFunc, args ...interface{}) {
+	key := r.key
+
+	table.Lock()
+	if table.refreshing[key] {
+		table.Unlock()
+		return
+	}
+	table.refreshing[key] = true
+	table.Unlock()
+
+	go func() {
+		item, _ := table.loadItem(key, loadData, args...)
+
+		table.Lock()
+		delete(table.refreshing, key)
+		table.Unlock()
+
+		// 加载失败继续使用当前条目
+		if item == nil {
+			return
+		}
+
+		// 加载期间条目被删除或者替换了，不能覆盖新的写入
+		if _, err := table.replaceLoaded(item, r); err == nil {
+			table.log("Refreshed item with key", key, "in table", table.name)
+		}
+	}()
+}
+
+// 加入负缓存条目
+func (table *CacheTable) addNegative(key interface{}) {
+	table.Lock()
+
+	lifeSpan := table.negativeLifeSpan
+	// 加载期间可能有其他调用者加入了该key
+	if _, ok := table.items[key]; ok || lifeSpan <= 0 {
+		table.Unlock()
+		return
+	}
+
+	table.log("Adding negative item with key", key,
+		"and lifeSpan of", lifeSpan,
+		"to table", table.name)
+
+	table.negatives[key] = time.Now().Add(lifeSpan)
+	expDur := table.cleanupInterval
+
+	table.Unlock()
+
+	// 同addInternal，负缓存比当前最短的过期时间还早过期，主动触发过期检测
+	if expDur == 0 || lifeSpan < expDur {
+		table.expirationCheck()
+	}
+}
+
+// Flush的选项
+type FlushOption func(*flushOptions)
+
+// Flush的选项集合
+type flushOptions struct {
+	// 是否触发移除的回调函数
+	callbacks bool
+}
+
+// Flush时触发 缓存表的aboutToDeleteItem、removalListeners 和 缓存条目的aboutToExpire
+// 移除原因是RemovalFlushed
+func FlushWithCallbacks() FlushOption {
+	return func(o *flushOptions) {
+		o.callbacks = true
+	}
+}
+
+// 清除所有的缓存条目，默认不会调用 缓存表的aboutToDeleteItem 和 缓存条目的aboutToExpire 
+// 可以通过FlushWithCallbacks触发
+func (table *CacheTable) Flush(opts ...FlushOption) {
+	var o flushOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	table.Lock()
-	defer table.Unlock()
 
 	table.log("Flushing table", table.name)
 
+	items := table.items
 	table.items = make(map[interface{}]*CacheItem)
+	table.negatives = make(map[interface{}]time.Time)
+	table.stale = nil
+	table.scanIndex = nil
 	table.cleanupInterval = 0
 	if table.cleanupTimer != nil {
 		table.cleanupTimer.Stop()
 	}
+
+	table.Unlock()
+
+	if o.callbacks {
+		for _, item := range items {
+			table.notifyRemoval(item, RemovalFlushed)
+		}
+	}
+}
+
+// 清除满足pred的缓存条目，返回清除的个数
+// 和Flush一样默认不触发回调函数，不会删除绑定的存储中的数据
+// pred不持有表的锁调用，可以访问缓存表
+func (table *CacheTable) FlushWhere(pred func(key interface{}, item *CacheItem) bool, opts ...FlushOption) int {
+	var o flushOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	matched := table.match(pred)
+
+	table.Lock()
+
+	var removed []*CacheItem
+	for _, item := range matched {
+		// 调用pred期间被替换或者删除了
+		if table.items[item.key] != item {
+			continue
+		}
+		delete(table.items, item.key)
+		delete(table.stale, item.key)
+		removed = append(removed, item)
+	}
+	table.compactScanIndex()
+
+	table.log("Flushing", len(removed), "items from table", table.name)
+
+	table.Unlock()
+
+	if o.callbacks {
+		for _, item := range removed {
+			table.notifyRemoval(item, RemovalFlushed)
+		}
+	}
+
+	return len(removed)
+}
+
+// 删除满足pred的缓存条目，返回删除的个数
+// 和Delete一样触发回调函数，移除原因是RemovalExplicit，绑定了存储时也会从存储中删除
+// pred不持有表的锁调用，可以访问缓存表，调用后被替换的条目不会删除
+func (table *CacheTable) DeleteFunc(pred func(key interface{}, item *CacheItem) bool) int {
+	n := 0
+	for _, item := range table.match(pred) {
+		if _, err := table.deleteMatched(item); err == nil {
+			n++
+		}
+	}
+
+	return n
+}
+
+// 删除匹配到的条目，key对应的条目已经不是item时返回ErrVersionMismatch
+func (table *CacheTable) deleteMatched(item *CacheItem) (*CacheItem, error) {
+	return table.intercept(&Op{Kind: OpDelete, Key: item.key}, func(op *Op) (*CacheItem, error) {
+		check := func() error {
+			table.RLock()
+			defer table.RUnlock()
+			if table.items[op.Key] != item {
+				return ErrVersionMismatch
+			}
+			return nil
+		}
+
+		return table.storeFirst(op.Key, nil, true, check, func() (*CacheItem, error) {
+			if !table.removeIf(op.Key, item, RemovalExplicit) {
+				return nil, ErrVersionMismatch
+			}
+			return item, nil
+		})
+	})
+}
+
+// 返回满足pred的条目，遍历的是快照，调用pred时不持有表的锁
+func (table *CacheTable) match(pred func(key interface{}, item *CacheItem) bool) []*CacheItem {
+	table.RLock()
+	snapshot := make([]*CacheItem, 0, len(table.items))
+	for _, item := range table.items {
+		snapshot = append(snapshot, item)
+	}
+	table.RUnlock()
+
+	var matched []*CacheItem
+	for _, item := range snapshot {
+		if pred(item.key, item) {
+			matched = append(matched, item)
+		}
+	}
+
+	return matched
+}
+
+// 调用回调函数，panic转换成ErrCallbackPanic交给onError
+// 保证回调函数的panic不会影响表的状态和后面的回调函数
+func (table *CacheTable) safeCall(f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			table.reportError(fmt.Errorf("%w: %v", ErrCallbackPanic, r))
+		}
+	}()
+
+	f()
+}
+
+// 记录错误日志并触发onError
+func (table *CacheTable) reportError(err error) {
+	table.log("Error in table", table.name, ":", err)
+
+	table.RLock()
+	onError := table.onError
+	table.RUnlock()
+
+	if onError == nil {
+		return
+	}
+
+	// onError本身的panic只能丢弃
+	defer func() {
+		recover()
+	}()
+	onError(err)
 }
 
 // 内部打印日志
@@ -389,7 +1148,7 @@ func (p CacheItemPairList) Less(i, j int) bool {
 // 获取访问最多的几个CacheItem，最多返回count个条目
 func (table *CacheTable) MostAccessed(count int64) []*CacheItem {
 	table.RLock()
-	defer table.RLock()
+	defer table.RUnlock()
 
 	p := make(CacheItemPairList, len(table.items))
 	i := 0
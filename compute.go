@@ -0,0 +1,333 @@
+// 封装了对条目原子读改写的操作
+
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"sync"
+	"time"
+)
+
+// 保留原条目的保活时间，并且不重置原条目的访问时间，原条目不存在时等于0
+const KeepLifeSpan time.Duration = -1
+
+// 读改写函数对条目的处理
+type computeAction int
+
+const (
+	// 写入新的data
+	computeSet computeAction = iota
+	// 删除条目
+	computeDelete
+	// 不修改条目
+	computeNone
+)
+
+// 单个key的锁，refs等于0时从表中删除
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// 对key加锁，返回解锁函数
+// 同一个key的Update、Compute、GetOrCompute、CompareAndSwap等串行执行
+func (table *CacheTable) lockKey(key interface{}) func() {
+	table.Lock()
+	l, ok := table.keyLocks[key]
+	if !ok {
+		l = &keyLock{}
+		table.keyLocks[key] = l
+	}
+	l.refs++
+	table.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		table.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(table.keyLocks, key)
+		}
+		table.Unlock()
+	}
+}
+
+// 在key的锁中原子的读改写条目，old是当前的条目，不存在时为nil
+// f返回keep为true时用data替换条目，替换的条目触发RemovalReplaced的回调函数，
+// 返回false时删除条目，触发RemovalExplicit的回调函数，old为nil时什么都不做
+// lifeSpan等于KeepLifeSpan时保留原条目的保活时间
+// 期间条目被Add、Delete等修改了，会用新的条目重新调用f，f不能调用该表的Compute
+// 写入和删除分别经过OpAdd和OpDelete拦截器，Before不能重写key，返回写入的条目，删除时返回nil
+// 被拦截器中止或者WriteThrough写入存储失败时不修改缓存，返回nil，错误交给onError
+func (table *CacheTable) Compute(key interface{}, lifeSpan time.Duration, f func(old *CacheItem) (data interface{}, keep bool), opts ...ItemOption) *CacheItem {
+	item, err := table.compute(key, func(old *CacheItem) (*CacheItem, computeAction) {
+		data, keep := f(old)
+		if !keep {
+			return nil, computeDelete
+		}
+		return newComputedItem(key, lifeSpan, data, old, opts...), computeSet
+	})
+	if err != nil {
+		table.reportError(err)
+	}
+
+	return item
+}
+
+// Compute的实现，f返回要写入的新条目，computeNone时返回当前的条目
+// 经过拦截器，先写入存储再修改缓存，返回拦截器中止的错误和WriteThrough写入存储失败的错误
+func (table *CacheTable) compute(key interface{}, f func(old *CacheItem) (*CacheItem, computeAction)) (*CacheItem, error) {
+	unlock := table.lockKey(key)
+	defer unlock()
+
+	table.RLock()
+	interceptors := table.interceptors
+	table.RUnlock()
+
+	for {
+		table.RLock()
+		old := table.items[key]
+		table.RUnlock()
+
+		item, action := f(old)
+
+		var op *Op
+		var write func() bool
+		switch action {
+		case computeNone:
+			return old, nil
+		case computeDelete:
+			if old == nil {
+				return nil, nil
+			}
+			op = &Op{Kind: OpDelete, Key: key}
+			item = old
+			write = func() bool {
+				return table.removeIf(key, old, RemovalExplicit)
+			}
+		default:
+			op = &Op{Kind: OpAdd, Key: key, Data: item.data, LifeSpan: item.lifeSpan}
+			write = func() bool {
+				return table.addIf(item, old)
+			}
+		}
+
+		err := table.computeWrite(interceptors, op, item, write)
+		if err == ErrVersionMismatch {
+			// 期间条目被修改了，用新的条目重新调用f
+			continue
+		}
+		if err != nil || action == computeDelete {
+			return nil, err
+		}
+		return item, nil
+	}
+}
+
+// 经过拦截器执行compute的写入或删除，item是要写入或者删除的条目
+// 条目已经被修改，write返回false时返回ErrVersionMismatch
+func (table *CacheTable) computeWrite(interceptors []callbackEntry[Interceptor], op *Op, item *CacheItem, write func() bool) error {
+	key := op.Key
+	deleted := op.Kind == OpDelete
+
+	err := table.runBefore(interceptors, op)
+	if err == nil && op.Key != key {
+		// 已经持有key的锁，不能改成其他的key
+		err = ErrKeyRewritten
+	}
+	if err == nil && !deleted {
+		// 条目还没有加入表中，可以直接修改
+		item.data = op.Data
+		item.lifeSpan = op.LifeSpan
+	}
+	undo := func() {}
+	if err == nil {
+		undo, err = table.storeBeforeUndo(key, op.Data, deleted)
+	}
+	if err == nil {
+		if write() {
+			table.storeAfter(key, op.Data, deleted)
+		} else {
+			// 写入存储期间条目被过期、Flush等修改了，恢复存储中原来的数据
+			undo()
+			err = ErrVersionMismatch
+		}
+	}
+
+	if err != nil {
+		table.runAfter(interceptors, op, nil, err)
+	} else {
+		table.runAfter(interceptors, op, item, nil)
+	}
+
+	return err
+}
+
+// 创建读改写的新条目，lifeSpan等于KeepLifeSpan时保留old的保活时间和访问时间
+func newComputedItem(key interface{}, lifeSpan time.Duration, data interface{}, old *CacheItem, opts ...ItemOption) *CacheItem {
+	item := NewCacheItem(key, lifeSpan, data, opts...)
+	if lifeSpan != KeepLifeSpan {
+		return item
+	}
+
+	item.lifeSpan = 0
+	if old != nil {
+		old.RLock()
+		item.lifeSpan = old.lifeSpan
+		item.accessedOn = old.accessedOn
+		item.accessCount = old.accessCount
+		old.RUnlock()
+	}
+
+	return item
+}
+
+// 原子的更新已经存在的条目，f接收当前条目的data，保留原条目的保活时间
+// f返回keep为false时删除条目，key不存在时返回ErrKeyNotFound
+func (table *CacheTable) Update(key interface{}, f func(old interface{}) (data interface{}, keep bool)) (*CacheItem, error) {
+	var err error
+	item, werr := table.compute(key, func(old *CacheItem) (*CacheItem, computeAction) {
+		if old == nil {
+			err = ErrKeyNotFound
+			return nil, computeNone
+		}
+		err = nil
+
+		data, keep := f(old.Data())
+		if !keep {
+			return nil, computeDelete
+		}
+		return newComputedItem(key, KeepLifeSpan, data, old), computeSet
+	})
+	if werr != nil {
+		return nil, werr
+	}
+
+	return item, err
+}
+
+// 获取条目，不存在时调用f创建并加入表中
+// 同一个key同时只会调用一次f，f返回错误时不加入表中
+func (table *CacheTable) GetOrCompute(key interface{}, lifeSpan time.Duration, f func() (interface{}, error)) (*CacheItem, error) {
+	var hit bool
+	var err error
+	item, werr := table.compute(key, func(old *CacheItem) (*CacheItem, computeAction) {
+		if hit = old != nil; hit {
+			return nil, computeNone
+		}
+
+		var data interface{}
+		if data, err = f(); err != nil {
+			return nil, computeNone
+		}
+		return NewCacheItem(key, lifeSpan, data), computeSet
+	})
+	if werr != nil {
+		return nil, werr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if hit {
+		table.hit(item)
+	}
+
+	return item, nil
+}
+
+// key对应条目的版本号等于version时用data替换条目，保留原条目的保活时间
+// key不存在时返回ErrKeyNotFound，版本号不一致时返回ErrVersionMismatch
+func (table *CacheTable) CompareAndSwap(key interface{}, version uint64, data interface{}) (*CacheItem, error) {
+	var err error
+	item, werr := table.compute(key, func(old *CacheItem) (*CacheItem, computeAction) {
+		if err = checkVersion(old, version); err != nil {
+			return nil, computeNone
+		}
+		return newComputedItem(key, KeepLifeSpan, data, old), computeSet
+	})
+	if werr != nil {
+		return nil, werr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+// key对应条目的版本号等于version时删除条目，返回被删除的条目
+func (table *CacheTable) CompareAndDelete(key interface{}, version uint64) (*CacheItem, error) {
+	var err error
+	var deleted *CacheItem
+	_, werr := table.compute(key, func(old *CacheItem) (*CacheItem, computeAction) {
+		if err = checkVersion(old, version); err != nil {
+			return nil, computeNone
+		}
+		deleted = old
+		return nil, computeDelete
+	})
+	if werr != nil {
+		return nil, werr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return deleted, nil
+}
+
+// 检查条目的版本号
+func checkVersion(item *CacheItem, version uint64) error {
+	if item == nil {
+		return ErrKeyNotFound
+	}
+	if item.version != version {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// key对应的条目还是old时才加入item，old为nil说明key不存在
+func (table *CacheTable) addIf(item *CacheItem, old *CacheItem) bool {
+	table.Lock()
+
+	if table.items[item.key] != old {
+		table.Unlock()
+		return false
+	}
+
+	table.addInternal(item)
+
+	return true
+}
+
+// key对应的条目还是old时才删除
+func (table *CacheTable) removeIf(key interface{}, old *CacheItem, cause RemovalCause) bool {
+	table.Lock()
+
+	if table.items[key] != old {
+		table.Unlock()
+		return false
+	}
+
+	delete(table.items, key)
+	if cause != RemovalExpired {
+		delete(table.stale, key)
+	}
+	table.compactScanIndex()
+	table.Unlock()
+
+	table.notifyRemoval(old, cause)
+
+	return true
+}
@@ -0,0 +1,85 @@
+// 封装了对计数器的操作
+
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"time"
+)
+
+// 计数器的选项
+type CounterOption func(*counterOptions)
+
+// 计数器的选项集合
+type counterOptions struct {
+	// 增加计数时是否不重置访问时间
+	noKeepAlive bool
+}
+
+// 增加计数时不重置访问时间，计数器在创建或者最近一次访问后经过lifeSpan过期
+// 例如固定窗口的限流计数
+func CounterWithoutKeepAlive() CounterOption {
+	return func(o *counterOptions) {
+		o.noKeepAlive = true
+	}
+}
+
+// 原子的给int64计数器加上delta，返回加上后的值
+// 计数器不存在时以delta创建，保活时间为lifeSpan，已经存在时保留原来的保活时间
+// 条目data不是int64时返回ErrNotCounter
+func (table *CacheTable) Incr(key interface{}, delta int64, lifeSpan time.Duration, opts ...CounterOption) (int64, error) {
+	return incr(table, key, delta, lifeSpan, opts)
+}
+
+// 原子的给int64计数器减去delta，同Incr
+func (table *CacheTable) Decr(key interface{}, delta int64, lifeSpan time.Duration, opts ...CounterOption) (int64, error) {
+	return incr(table, key, -delta, lifeSpan, opts)
+}
+
+// 原子的给float64计数器加上delta，同Incr
+// 条目data不是float64时返回ErrNotCounter
+func (table *CacheTable) IncrFloat(key interface{}, delta float64, lifeSpan time.Duration, opts ...CounterOption) (float64, error) {
+	return incr(table, key, delta, lifeSpan, opts)
+}
+
+// 计数器的实现，每次增加都会替换条目
+func incr[T int64 | float64](table *CacheTable, key interface{}, delta T, lifeSpan time.Duration, opts []CounterOption) (T, error) {
+	var o counterOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var n T
+	var err error
+	_, werr := table.compute(key, func(old *CacheItem) (*CacheItem, computeAction) {
+		if old == nil {
+			n, err = delta, nil
+			return NewCacheItem(key, lifeSpan, n), computeSet
+		}
+
+		v, ok := old.Data().(T)
+		if !ok {
+			err = ErrNotCounter
+			return nil, computeNone
+		}
+
+		n, err = v+delta, nil
+		item := newComputedItem(key, KeepLifeSpan, n, old)
+		if !o.noKeepAlive {
+			item.accessedOn = time.Now()
+			item.accessCount++
+		}
+		return item, computeSet
+	})
+	if werr != nil {
+		return 0, werr
+	}
+
+	return n, err
+}
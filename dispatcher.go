@@ -0,0 +1,228 @@
+// 封装了对回调函数分发的操作
+
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// 回调队列满了时的处理方式
+type OverflowPolicy int
+
+const (
+	// 阻塞调用者直到队列有空间
+	OverflowBlock OverflowPolicy = iota
+	// 丢弃回调，计入统计信息
+	OverflowDrop
+	// 超出的部分放入不限长度的溢出队列
+	OverflowSpill
+)
+
+// 异步分发回调函数的选项
+type DispatchOptions struct {
+	// 工作协程个数，等于0说明在调用者的协程中同步调用
+	Workers int
+	// 每个工作协程的队列长度，小于等于0时使用1
+	QueueSize int
+	// 队列满了时的处理方式
+	Overflow OverflowPolicy
+}
+
+// 回调函数分发器
+// 同一个key的回调总是交给同一个工作协程，保证按顺序调用
+type dispatcher struct {
+	queues []*dispatchQueue
+	queueSize int
+	overflow OverflowPolicy
+
+	// 保护pending
+	mu sync.Mutex
+	// pending变为0时广播
+	idle *sync.Cond
+	// 还没有调用完成的回调个数
+	pending int
+	// 被丢弃的回调个数
+	dropped int64
+}
+
+// 一个工作协程的队列
+type dispatchQueue struct {
+	sync.Mutex
+	// 队列不为空
+	notEmpty *sync.Cond
+	// 队列有空间
+	notFull *sync.Cond
+
+	tasks []func()
+	closed bool
+}
+
+// 设置异步分发回调函数，Workers等于0说明恢复同步调用
+// 以前的分发器会在调用完所有排队的回调后关闭
+// 使用OverflowBlock时，回调函数中不应该再修改同一个表，可能造成死锁
+func (table *CacheTable) SetCallbackDispatch(opts DispatchOptions) {
+	var d *dispatcher
+	if opts.Workers > 0 {
+		d = newDispatcher(opts)
+	}
+
+	table.Lock()
+	old := table.dispatcher
+	table.dispatcher = d
+	table.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+}
+
+// 等待所有排队的回调函数调用完成，用于关闭前
+func (table *CacheTable) Drain() {
+	table.RLock()
+	d := table.dispatcher
+	table.RUnlock()
+
+	if d != nil {
+		d.drain()
+	}
+}
+
+// 分发回调，没有设置异步分发时直接调用
+func (table *CacheTable) dispatch(key interface{}, task func()) {
+	table.RLock()
+	d := table.dispatcher
+	table.RUnlock()
+
+	if d == nil {
+		task()
+		return
+	}
+
+	d.submit(key, task)
+}
+
+// 创建分发器并启动工作协程
+func newDispatcher(opts DispatchOptions) *dispatcher {
+	d := &dispatcher{
+		queueSize: opts.QueueSize,
+		overflow: opts.Overflow,
+	}
+	if d.queueSize <= 0 {
+		d.queueSize = 1
+	}
+	d.idle = sync.NewCond(&d.mu)
+
+	for i := 0; i < opts.Workers; i++ {
+		q := &dispatchQueue{}
+		q.notEmpty = sync.NewCond(q)
+		q.notFull = sync.NewCond(q)
+		d.queues = append(d.queues, q)
+
+		go d.run(q)
+	}
+
+	return d
+}
+
+// 把回调放入key对应的队列
+func (d *dispatcher) submit(key interface{}, task func()) {
+	h := fnv.New32a()
+	fmt.Fprint(h, key)
+	q := d.queues[h.Sum32()%uint32(len(d.queues))]
+
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.tasks) >= d.queueSize {
+		switch d.overflow {
+		case OverflowBlock:
+			for len(q.tasks) >= d.queueSize && !q.closed {
+				q.notFull.Wait()
+			}
+		case OverflowDrop:
+			atomic.AddInt64(&d.dropped, 1)
+			return
+		}
+	}
+
+	// 已经关闭的分发器直接调用
+	if q.closed {
+		q.Unlock()
+		task()
+		q.Lock()
+		return
+	}
+
+	d.mu.Lock()
+	d.pending++
+	d.mu.Unlock()
+
+	q.tasks = append(q.tasks, task)
+	q.notEmpty.Signal()
+}
+
+// 工作协程，依次调用队列中的回调
+func (d *dispatcher) run(q *dispatchQueue) {
+	for {
+		q.Lock()
+		for len(q.tasks) == 0 && !q.closed {
+			q.notEmpty.Wait()
+		}
+		if len(q.tasks) == 0 {
+			q.Unlock()
+			return
+		}
+
+		task := q.tasks[0]
+		q.tasks[0] = nil
+		q.tasks = q.tasks[1:]
+		q.notFull.Signal()
+		q.Unlock()
+
+		task()
+
+		d.mu.Lock()
+		d.pending--
+		if d.pending == 0 {
+			d.idle.Broadcast()
+		}
+		d.mu.Unlock()
+	}
+}
+
+// 等待所有排队的回调调用完成
+func (d *dispatcher) drain() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for d.pending > 0 {
+		d.idle.Wait()
+	}
+}
+
+// 调用完所有排队的回调后关闭工作协程
+func (d *dispatcher) close() {
+	for _, q := range d.queues {
+		q.Lock()
+		q.closed = true
+		q.notEmpty.Broadcast()
+		q.notFull.Broadcast()
+		q.Unlock()
+	}
+
+	d.drain()
+}
+
+// 返回被丢弃的回调个数
+func (d *dispatcher) Dropped() int64 {
+	return atomic.LoadInt64(&d.dropped)
+}
@@ -18,4 +18,24 @@ var (
 	ErrKeyNotFound = errors.New("Key not found in cache")
 	// key 不存在 或者 loadData 无法创建 条目
 	ErrKeyNotFoundOrLoadable = errors.New("Key not found and could not be loaded into cache")
+	// 加载超时
+	ErrLoaderTimeout = errors.New("Loader timed out")
+	// 熔断中，加载直接失败
+	ErrCircuitOpen = errors.New("Loader circuit breaker is open")
+	// key 已经存在表中
+	ErrKeyExists = errors.New("Key already exists in cache")
+	// 回调函数panic
+	ErrCallbackPanic = errors.New("Callback panicked")
+	// 加载函数panic
+	ErrLoaderPanic = errors.New("Loader panicked")
+	// 绑定的存储panic
+	ErrStorePanic = errors.New("Store panicked")
+	// 没有可以加载key的加载函数
+	ErrNoLoader = errors.New("No loader for key")
+	// 条目的版本号和期望的不一致，期间被修改了
+	ErrVersionMismatch = errors.New("Item version mismatch")
+	// 条目data不是计数器需要的数字类型
+	ErrNotCounter = errors.New("Item data is not a counter")
+	// 读改写操作中拦截器重写了key
+	ErrKeyRewritten = errors.New("Interceptor rewrote the key of a compute operation")
 )
\ No newline at end of file
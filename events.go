@@ -0,0 +1,176 @@
+// 封装了对缓存事件流的操作
+
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 事件类型，可以按位组合用于过滤
+type EventType int
+
+const (
+	// 加入了新的key
+	EventAdded EventType = 1 << iota
+	// 已经存在的key被新条目替换
+	EventUpdated
+	// 条目被访问
+	EventAccessed
+	// 条目被移除，被替换时只有EventUpdated
+	EventRemoved
+)
+
+// 缓存事件
+type Event struct {
+	// 事件类型
+	Type EventType
+	// 条目key
+	Key interface{}
+	// 事件发生时条目的快照，不会触发回调函数
+	Item *CacheItem
+	// 移除原因，只有EventRemoved有效
+	Cause RemovalCause
+	// 事件发生的时间
+	Time time.Time
+}
+
+// 事件流，通过C接收事件
+type EventStream struct {
+	// 接收事件的通道，取消订阅后关闭
+	C <-chan Event
+
+	// 保护ch和closed，避免向关闭的通道发送
+	mu sync.Mutex
+	ch chan Event
+	closed bool
+
+	// 过滤函数，nil说明接收所有事件
+	filter func(e Event) bool
+	// 缓冲满了被丢弃的事件个数
+	dropped uint64
+	// 从表中删除
+	sub *Subscription
+}
+
+// 事件类型的描述
+func (t EventType) String() string {
+	switch t {
+	case EventAdded:
+		return "added"
+	case EventUpdated:
+		return "updated"
+	case EventAccessed:
+		return "accessed"
+	case EventRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// 订阅缓存事件，filter返回true的事件会发送到返回的事件流，nil说明接收所有事件
+// 每个订阅者有自己的缓冲，缓冲满了时丢弃事件并计数，不会阻塞缓存表
+// 和回调函数一样，没有触发回调函数的Flush不会产生事件
+func (table *CacheTable) Subscribe(filter func(e Event) bool, buffer int) *EventStream {
+	ch := make(chan Event, buffer)
+	s := &EventStream{
+		C: ch,
+		ch: ch,
+		filter: filter,
+	}
+
+	table.Lock()
+	defer table.Unlock()
+
+	e := newCallbackEntry(s)
+	table.streams = append(table.streams, e)
+
+	s.sub = newSubscription(func() {
+		table.Lock()
+		table.streams = removeCallback(table.streams, e.id)
+		table.Unlock()
+
+		s.mu.Lock()
+		s.closed = true
+		close(s.ch)
+		s.mu.Unlock()
+	})
+
+	return s
+}
+
+// 监听单个key的添加、替换、访问和移除事件
+func (table *CacheTable) Watch(key interface{}, buffer int) *EventStream {
+	return table.Subscribe(func(e Event) bool {
+		return e.Key == key
+	}, buffer)
+}
+
+// 监听以prefix开头的string类型key的事件，其他类型的key不会匹配
+func (table *CacheTable) WatchPrefix(prefix string, buffer int) *EventStream {
+	return table.Subscribe(func(e Event) bool {
+		s, ok := e.Key.(string)
+		return ok && strings.HasPrefix(s, prefix)
+	}, buffer)
+}
+
+// 取消订阅，关闭C
+func (s *EventStream) Unsubscribe() {
+	s.sub.Unsubscribe()
+}
+
+// 返回缓冲满了被丢弃的事件个数
+func (s *EventStream) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// 发送事件，缓冲满了时丢弃
+func (s *EventStream) send(e Event) {
+	if s.filter != nil && !s.filter(e) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	select {
+	case s.ch <- e:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// 发布事件，调用时不能持有表的锁
+func (table *CacheTable) publish(t EventType, item *CacheItem, cause RemovalCause) {
+	table.RLock()
+	streams := table.streams
+	table.RUnlock()
+
+	if len(streams) == 0 {
+		return
+	}
+
+	e := Event{
+		Type: t,
+		Key: item.key,
+		Item: item.snapshot(),
+		Cause: cause,
+		Time: time.Now(),
+	}
+	for _, s := range streams {
+		table.safeCall(func() { s.f.send(e) })
+	}
+}
@@ -0,0 +1,161 @@
+// 封装了对拦截器的操作
+
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"fmt"
+	"time"
+)
+
+// 被拦截的操作类型
+type OpKind int
+
+const (
+	// Add、NotFoundAdd、Replace、AddOrUpdate，以及加载函数加载到的条目
+	OpAdd OpKind = iota
+	// Value
+	OpValue
+	// Delete
+	OpDelete
+)
+
+// 被拦截的操作，Before中可以重写
+type Op struct {
+	// 操作类型
+	Kind OpKind
+	// 条目key，可以重写，例如规范化key
+	Key interface{}
+	// 条目data，只有OpAdd有效
+	Data interface{}
+	// 条目保活时间，只有OpAdd有效
+	LifeSpan time.Duration
+}
+
+// 拦截器，类似中间件
+type Interceptor struct {
+	// 操作前调用，可以重写op，返回错误会中止操作，后面的拦截器不再调用
+	Before func(op *Op) error
+	// 操作后调用，包括被中止的操作，item和err是操作的结果
+	After func(op *Op, item *CacheItem, err error)
+}
+
+// 操作类型的描述
+func (k OpKind) String() string {
+	switch k {
+	case OpAdd:
+		return "add"
+	case OpValue:
+		return "value"
+	case OpDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// 添加拦截器，按添加顺序调用Before，返回的订阅可以单独删除该拦截器
+func (table *CacheTable) AddInterceptor(i Interceptor) *Subscription {
+	table.Lock()
+	defer table.Unlock()
+
+	e := newCallbackEntry(i)
+	table.interceptors = append(table.interceptors, e)
+
+	return newSubscription(func() {
+		table.Lock()
+		defer table.Unlock()
+		table.interceptors = removeCallback(table.interceptors, e.id)
+	})
+}
+
+// 经过拦截器执行操作，调用时不能持有表的锁
+func (table *CacheTable) intercept(op *Op, f func(op *Op) (*CacheItem, error)) (*CacheItem, error) {
+	table.RLock()
+	interceptors := table.interceptors
+	table.RUnlock()
+
+	if len(interceptors) == 0 {
+		return f(op)
+	}
+
+	var item *CacheItem
+	err := table.runBefore(interceptors, op)
+	if err == nil {
+		item, err = f(op)
+	}
+
+	table.runAfter(interceptors, op, item, err)
+
+	return item, err
+}
+
+// 依次调用Before，直到返回错误
+func (table *CacheTable) runBefore(interceptors []callbackEntry[Interceptor], op *Op) error {
+	for _, i := range interceptors {
+		if i.f.Before == nil {
+			continue
+		}
+		if err := table.before(i.f.Before, op); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 调用所有的After
+func (table *CacheTable) runAfter(interceptors []callbackEntry[Interceptor], op *Op, item *CacheItem, err error) {
+	for _, i := range interceptors {
+		if i.f.After != nil {
+			table.safeCall(func() { i.f.After(op, item, err) })
+		}
+	}
+}
+
+// 调用Before，panic转换成ErrCallbackPanic中止操作
+func (table *CacheTable) before(f func(op *Op) error, op *Op) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrCallbackPanic, r)
+			table.reportError(err)
+		}
+	}()
+
+	return f(op)
+}
+
+// 把加载函数加载到的条目经过OpAdd拦截器加入表中
+func (table *CacheTable) addLoaded(loaded *CacheItem) (*CacheItem, error) {
+	return table.replaceLoaded(loaded, nil)
+}
+
+// 同addLoaded，old不为nil时，key对应的条目还是old才加入
+// 否则说明加载期间条目被修改了，返回ErrVersionMismatch
+func (table *CacheTable) replaceLoaded(loaded *CacheItem, old *CacheItem) (*CacheItem, error) {
+	op := &Op{
+		Kind: OpAdd,
+		Key: loaded.key,
+		Data: loaded.data,
+		LifeSpan: loaded.lifeSpan,
+	}
+
+	return table.intercept(op, func(op *Op) (*CacheItem, error) {
+		item := NewCacheItem(op.Key, op.LifeSpan, op.Data).callbacksFrom(loaded)
+		item.computeTime = loaded.computeTime
+
+		table.Lock()
+		if old != nil && table.items[op.Key] != old {
+			table.Unlock()
+			return nil, ErrVersionMismatch
+		}
+		table.addInternal(item)
+
+		return item, nil
+	})
+}
@@ -0,0 +1,63 @@
+// 封装了对缓存条目迭代器的操作
+
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"iter"
+)
+
+// 返回所有key<->条目的迭代器
+// 开始迭代时对表做快照，迭代期间不持有表的锁，可以增删条目，也可以break
+// 迭代期间加入的条目不会被遍历到，删除的条目仍然会被遍历到
+// 遍历不算访问，不会更新访问时间和访问次数
+func (table *CacheTable) All() iter.Seq2[interface{}, *CacheItem] {
+	return func(yield func(interface{}, *CacheItem) bool) {
+		for _, item := range table.snapshotItems() {
+			if !yield(item.key, item) {
+				return
+			}
+		}
+	}
+}
+
+// 返回所有key的迭代器，同All
+func (table *CacheTable) Keys() iter.Seq[interface{}] {
+	return func(yield func(interface{}) bool) {
+		for _, item := range table.snapshotItems() {
+			if !yield(item.key) {
+				return
+			}
+		}
+	}
+}
+
+// 返回所有条目的迭代器，同All
+func (table *CacheTable) Values() iter.Seq[*CacheItem] {
+	return func(yield func(*CacheItem) bool) {
+		for _, item := range table.snapshotItems() {
+			if !yield(item) {
+				return
+			}
+		}
+	}
+}
+
+// 返回表中当前所有的条目
+func (table *CacheTable) snapshotItems() []*CacheItem {
+	table.RLock()
+	defer table.RUnlock()
+
+	items := make([]*CacheItem, 0, len(table.items))
+	for _, item := range table.items {
+		items = append(items, item)
+	}
+
+	return items
+}
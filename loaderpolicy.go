@@ -0,0 +1,308 @@
+// 封装了对加载策略的操作
+
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 带错误返回的加载函数，返回nil和nil说明key不存在，会加入负缓存
+// 返回错误说明加载失败，可以按加载策略重试，不会加入负缓存
+type LoaderFunc func(key interface{}, args ...interface{}) (*CacheItem, error)
+
+// 加载策略，零值说明不做任何保护
+type LoaderPolicy struct {
+	// 单次加载的超时时间，包括等待并发名额的时间，等于0说明不限制
+	Timeout time.Duration
+	// 加载失败后重试的次数
+	Retries int
+	// 第一次重试前等待的时间，之后每次翻倍，实际等待时间会加上随机抖动
+	Backoff time.Duration
+	// 重试等待时间的上限，等于0说明不限制
+	MaxBackoff time.Duration
+	// 同时进行的加载个数上限，超过时等待，等于0说明不限制
+	MaxConcurrent int
+	// 连续失败多少次后熔断，熔断期间加载直接返回ErrCircuitOpen，等于0说明不启用
+	BreakerThreshold int
+	// 熔断后经过多久允许一次试探性的加载
+	BreakerCooldown time.Duration
+	// 加载失败或者熔断时，返回该key最后一次加载到的条目，不返回错误
+	// 旧条目不会重新加入表中，下次访问仍然会尝试加载
+	// 会保留每个key最后一次加载的条目，Delete和Flush时清除
+	ServeStale bool
+}
+
+// 熔断器状态
+type BreakerState int
+
+const (
+	// 正常加载
+	BreakerClosed BreakerState = iota
+	// 熔断中，加载直接失败
+	BreakerOpen
+	// 冷却结束，允许一次试探性的加载
+	BreakerHalfOpen
+)
+
+// 熔断器状态的描述
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// 熔断器
+type breaker struct {
+	sync.Mutex
+
+	// 连续失败多少次后熔断
+	threshold int
+	// 熔断后经过多久允许试探
+	cooldown time.Duration
+
+	// 当前状态
+	state BreakerState
+	// 连续失败的次数
+	failures int
+	// 熔断的时间
+	openedOn time.Time
+	// 是否有试探性的加载正在进行
+	probing bool
+}
+
+// 设置带错误返回的加载函数，会替换SetDataLoader设置的函数
+func (table *CacheTable) SetLoader(f LoaderFunc) {
+	table.Lock()
+	defer table.Unlock()
+	table.loadData = f
+}
+
+// 设置加载策略，对loadData和批量加载函数都生效
+// 会重置熔断器的状态
+func (table *CacheTable) SetLoaderPolicy(policy LoaderPolicy) {
+	table.Lock()
+	defer table.Unlock()
+
+	table.loaderPolicy = policy
+
+	table.loaderSem = nil
+	if policy.MaxConcurrent > 0 {
+		table.loaderSem = make(chan struct{}, policy.MaxConcurrent)
+	}
+
+	table.stale = nil
+
+	table.breaker = nil
+	if policy.BreakerThreshold > 0 {
+		table.breaker = &breaker{
+			threshold: policy.BreakerThreshold,
+			cooldown: policy.BreakerCooldown,
+		}
+	}
+}
+
+// 按加载策略调用加载函数，熔断、并发上限、超时和重试
+// 一次调用，无论重试多少次，熔断器只记录一次结果
+func (table *CacheTable) guard(call func() (interface{}, error)) (interface{}, error) {
+	table.RLock()
+	policy := table.loaderPolicy
+	sem := table.loaderSem
+	b := table.breaker
+	table.RUnlock()
+
+	if b != nil {
+		if err := b.allow(); err != nil {
+			return nil, err
+		}
+	}
+
+	// 加载函数的panic转换成ErrLoaderPanic，可以重试，超时时也不会在后台协程中崩溃
+	recovered := func() (r interface{}, err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("%w: %v", ErrLoaderPanic, p)
+				table.reportError(err)
+			}
+		}()
+		return call()
+	}
+
+	var r interface{}
+	var err error
+	backoff := policy.Backoff
+	for attempt := 0; ; attempt++ {
+		r, err = callOnce(recovered, policy.Timeout, sem)
+		if err == nil || attempt >= policy.Retries {
+			break
+		}
+
+		table.log("Loader failed with", err, "retrying in table", table.name)
+
+		time.Sleep(jitter(backoff))
+		backoff *= 2
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+
+	if b != nil {
+		b.done(err)
+	}
+
+	if err != nil {
+		atomic.AddInt64(&table.loadFailures, 1)
+	} else {
+		atomic.AddInt64(&table.loadSuccesses, 1)
+	}
+
+	return r, err
+}
+
+// 调用一次加载函数
+// 超时后直接返回，加载函数在后台继续执行，结果被丢弃
+// 等待并发名额的时间也计入超时
+func callOnce(call func() (interface{}, error), timeout time.Duration, sem chan struct{}) (interface{}, error) {
+	if timeout <= 0 {
+		if sem != nil {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+		}
+		return call()
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	if sem != nil {
+		select {
+		case sem <- struct{}{}:
+		case <-timer.C:
+			return nil, ErrLoaderTimeout
+		}
+	}
+
+	type result struct {
+		r interface{}
+		err error
+	}
+	// 带缓冲，超时后加载函数返回也不会阻塞
+	ch := make(chan result, 1)
+	go func() {
+		r, err := call()
+		// 加载函数真正返回后才释放，超时的加载也占用并发数
+		if sem != nil {
+			<-sem
+		}
+		ch <- result{r, err}
+	}()
+
+	select {
+	case res := <-ch:
+		return res.r, res.err
+	case <-timer.C:
+		return nil, ErrLoaderTimeout
+	}
+}
+
+// 在[d/2, d]之间随机，避免大量调用者同时重试
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// 保留key最后一次加载到的条目，ServeStale时加载失败返回该条目
+func (table *CacheTable) keepStale(key interface{}, item *CacheItem) {
+	table.Lock()
+	defer table.Unlock()
+
+	if !table.loaderPolicy.ServeStale {
+		return
+	}
+	if table.stale == nil {
+		table.stale = make(map[interface{}]*CacheItem)
+	}
+	table.stale[key] = item
+}
+
+// 加载失败时返回key最后一次加载到的条目，没有时返回nil
+func (table *CacheTable) staleItem(key interface{}, err error) *CacheItem {
+	table.RLock()
+	item := table.stale[key]
+	table.RUnlock()
+
+	if item != nil {
+		table.log("Serving stale item with key", key, "after", err, "in table", table.name)
+	}
+
+	return item
+}
+
+// 是否允许加载
+func (b *breaker) allow() error {
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedOn) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return nil
+	case BreakerHalfOpen:
+		// 同时只允许一次试探
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+
+	return nil
+}
+
+// 记录一次加载的结果
+func (b *breaker) done(err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.probing = false
+
+	if err == nil {
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedOn = time.Now()
+	}
+}
+
+// 返回熔断器的状态
+func (b *breaker) State() BreakerState {
+	b.Lock()
+	defer b.Unlock()
+	return b.state
+}
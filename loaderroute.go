@@ -0,0 +1,97 @@
+// 封装了对加载函数路由和串联的操作
+
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 加载函数路由，key满足match时使用loader加载
+type loaderRoute struct {
+	match func(key interface{}) bool
+	loader LoaderFunc
+}
+
+// 串联多个加载函数，依次尝试，前一个返回不存在或者失败时尝试下一个
+// 都没有加载到时，只要有一个失败就返回最后一个错误，否则说明key不存在
+func ChainLoaders(loaders ...LoaderFunc) LoaderFunc {
+	return func(key interface{}, args ...interface{}) (*CacheItem, error) {
+		var lastErr error
+		for _, loader := range loaders {
+			item, err := loader(key, args...)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if item != nil {
+				return item, nil
+			}
+		}
+
+		return nil, lastErr
+	}
+}
+
+// 添加加载函数路由，key满足match时使用loader加载
+// 按添加顺序匹配，都不满足时使用loadData，匹配到路由的key不会合并批量加载
+func (table *CacheTable) AddLoaderRoute(match func(key interface{}) bool, loader LoaderFunc) {
+	table.Lock()
+	defer table.Unlock()
+	table.loaderRoutes = append(table.loaderRoutes, loaderRoute{match, loader})
+}
+
+// 添加按前缀匹配的加载函数路由，只匹配string类型的key
+func (table *CacheTable) AddPrefixLoader(prefix string, loader LoaderFunc) {
+	table.AddLoaderRoute(func(key interface{}) bool {
+		s, ok := key.(string)
+		return ok && strings.HasPrefix(s, prefix)
+	}, loader)
+}
+
+// 删除所有的加载函数路由
+func (table *CacheTable) RemoveLoaderRoutes() {
+	table.Lock()
+	defer table.Unlock()
+	table.loaderRoutes = nil
+}
+
+// 根据key选择加载函数，调用时不能持有表的锁，match不持有表的锁调用
+// 第二个返回值说明是否匹配到了路由，match panic时返回ErrCallbackPanic
+func (table *CacheTable) loaderFor(key interface{}) (LoaderFunc, bool, error) {
+	table.RLock()
+	routes := table.loaderRoutes
+	loadData := table.loadData
+	table.RUnlock()
+
+	for _, route := range routes {
+		matched, err := table.matchRoute(route.match, key)
+		if err != nil {
+			return nil, false, err
+		}
+		if matched {
+			return route.loader, true, nil
+		}
+	}
+
+	return loadData, false, nil
+}
+
+// 调用路由的match，panic转换成ErrCallbackPanic交给onError
+func (table *CacheTable) matchRoute(match func(key interface{}) bool, key interface{}) (matched bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrCallbackPanic, r)
+			table.reportError(err)
+		}
+	}()
+
+	return match(key), nil
+}
@@ -0,0 +1,43 @@
+// 封装了对条目移除原因的描述
+
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+// 条目被移除的原因
+type RemovalCause int
+
+const (
+	// 通过Delete删除
+	RemovalExplicit RemovalCause = iota
+	// 保活时间到了被过期检测删除
+	RemovalExpired
+	// 超过容量被淘汰
+	RemovalEvicted
+	// 被相同key的新条目替换
+	RemovalReplaced
+	// 被Flush清除
+	RemovalFlushed
+)
+
+// 移除原因的描述
+func (c RemovalCause) String() string {
+	switch c {
+	case RemovalExplicit:
+		return "explicit"
+	case RemovalExpired:
+		return "expired"
+	case RemovalEvicted:
+		return "evicted"
+	case RemovalReplaced:
+		return "replaced"
+	case RemovalFlushed:
+		return "flushed"
+	}
+	return "unknown"
+}
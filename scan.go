@@ -0,0 +1,96 @@
+// 封装了对游标分页遍历的操作
+
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// 类似Redis的SCAN，从cursor开始最多检查count个条目，返回其中key匹配match的key和下一次的游标
+// 第一次调用cursor传0，返回的游标等于0说明遍历结束
+// match是path.Match的模式，非string的key用fmt.Sprint转换后匹配，空字符串匹配所有key
+// 每次调用只短暂持有表的读锁，整个遍历期间一直存在的key至少返回一次，
+// 期间被替换的key可能返回多次，期间加入或者删除的key不保证返回
+func (table *CacheTable) Scan(cursor uint64, count int, match string) ([]interface{}, uint64, error) {
+	if match != "" {
+		// 提前检查模式
+		if _, err := path.Match(match, ""); err != nil {
+			return nil, 0, err
+		}
+	}
+	if count <= 0 {
+		count = 10
+	}
+
+	table.RLock()
+	defer table.RUnlock()
+
+	// 条目按版本号递增排列，游标是上一次检查的最后一个条目的版本号
+	index := table.scanIndex
+	i := sort.Search(len(index), func(i int) bool {
+		return index[i].version > cursor
+	})
+
+	var keys []interface{}
+	for checked := 0; i < len(index) && checked < count; i++ {
+		item := index[i]
+		// 已经被删除或者替换了
+		if table.items[item.key] != item {
+			continue
+		}
+		checked++
+		cursor = item.version
+
+		if match == "" || matchKey(match, item.key) {
+			keys = append(keys, item.key)
+		}
+	}
+
+	if i >= len(index) {
+		cursor = 0
+	}
+
+	return keys, cursor, nil
+}
+
+// key是否匹配模式
+func matchKey(pattern string, key interface{}) bool {
+	s, ok := key.(string)
+	if !ok {
+		s = fmt.Sprint(key)
+	}
+
+	matched, _ := path.Match(pattern, s)
+	return matched
+}
+
+// 把新加入的条目放到游标遍历的索引末尾，调用时需要持有表的锁
+func (table *CacheTable) indexItem(item *CacheItem) {
+	table.scanIndex = append(table.scanIndex, item)
+	table.compactScanIndex()
+}
+
+// 清理索引中删除和替换的条目，调用时需要持有表的锁
+// 删除和替换的条目留在索引中，超过表中条目个数一倍时再清理，加入和删除条目后都要调用
+func (table *CacheTable) compactScanIndex() {
+	if len(table.scanIndex) <= 2*len(table.items) + 64 {
+		return
+	}
+
+	index := make([]*CacheItem, 0, 2*len(table.items))
+	for _, r := range table.scanIndex {
+		if table.items[r.key] == r {
+			index = append(index, r)
+		}
+	}
+	table.scanIndex = index
+}
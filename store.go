@@ -0,0 +1,359 @@
+// 封装了对持久化存储的操作
+
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 持久化存储，缓存表绑定后作为数据源
+type Store interface {
+	// 加载key对应的data，found为false说明不存在
+	Load(key interface{}) (data interface{}, found bool, err error)
+	// 写入key对应的data
+	Store(key interface{}, data interface{}) error
+	// 删除key
+	Delete(key interface{}) error
+}
+
+// 写入存储的方式
+type StoreMode int
+
+const (
+	// Add和Delete先同步写入存储，写入失败时不修改缓存并返回错误
+	WriteThrough StoreMode = iota
+	// Add和Delete先缓冲，同一个key只保留最后一次，按间隔或者个数批量写入
+	WriteBehind
+)
+
+// 绑定存储的选项
+type StoreOptions struct {
+	// 写入存储的方式
+	Mode StoreMode
+	// 从存储加载的条目的保活时间
+	LifeSpan time.Duration
+	// WriteBehind写入的间隔，等于0时使用1秒
+	FlushInterval time.Duration
+	// WriteBehind缓冲的key达到多少个立即写入，等于0说明只按间隔写入
+	FlushSize int
+	// WriteBehind写入失败后最多重试几次，超过后丢弃并记录日志
+	MaxRetries int
+}
+
+// 绑定到缓存表的存储
+type boundStore struct {
+	sync.Mutex
+
+	store Store
+	opts StoreOptions
+	table *CacheTable
+
+	// 等待写入的key，同一个key只保留最后一次
+	pending map[interface{}]*pendingWrite
+	// 正在写入的key，写入完成前加载也需要看到
+	flushing map[interface{}]*pendingWrite
+
+	// 缓冲满了，通知立即写入
+	kick chan struct{}
+	// 关闭时通知写入协程退出
+	closing chan struct{}
+	// 写入协程退出后关闭，返回最后一次写入丢弃的错误
+	done chan error
+}
+
+// 一次等待写入的操作
+type pendingWrite struct {
+	data interface{}
+	// 是否是删除
+	deleted bool
+	// 已经重试的次数
+	retries int
+}
+
+// 绑定存储，缓存表未命中时从存储加载，Add和Delete会写入存储
+// 会替换SetDataLoader设置的函数，过期和Flush不会删除存储中的数据
+// 已经绑定了存储，会先关闭以前的存储
+func (table *CacheTable) BindStore(s Store, opts StoreOptions) {
+	table.Close()
+
+	bs := &boundStore{
+		store: s,
+		opts: opts,
+		table: table,
+		pending: make(map[interface{}]*pendingWrite),
+	}
+
+	if opts.Mode == WriteBehind {
+		if bs.opts.FlushInterval <= 0 {
+			bs.opts.FlushInterval = time.Second
+		}
+		bs.kick = make(chan struct{}, 1)
+		bs.closing = make(chan struct{})
+		bs.done = make(chan error, 1)
+		go bs.run()
+	}
+
+	table.Lock()
+	table.store = bs
+	table.Unlock()
+
+	table.SetLoader(bs.load)
+}
+
+// 关闭绑定的存储，WriteBehind会写入所有缓冲的数据后返回
+// 返回重试后仍然写入失败被丢弃的错误
+func (table *CacheTable) Close() error {
+	table.Lock()
+	bs := table.store
+	table.store = nil
+	table.Unlock()
+
+	if bs == nil || bs.opts.Mode != WriteBehind {
+		return nil
+	}
+
+	close(bs.closing)
+	return <-bs.done
+}
+
+// 先写入存储再修改缓存，f修改缓存
+// WriteThrough写入存储失败时不调用f，返回存储的错误，保证缓存和存储一致
+// 同一个key的写入串行执行，check不为nil时，在写入存储前检查是否需要写入，
+// 写入存储后f仍然可能失败，失败时恢复存储中原来的数据
+// WriteBehind在f成功后加入缓冲，删除不管缓存中是否存在都会从存储中删除
+func (table *CacheTable) storeFirst(key interface{}, data interface{}, deleted bool, check func() error, f func() (*CacheItem, error)) (*CacheItem, error) {
+	table.RLock()
+	bs := table.store
+	table.RUnlock()
+
+	if bs == nil || bs.opts.Mode != WriteThrough {
+		item, err := f()
+		if err == nil || (deleted && err == ErrKeyNotFound) {
+			table.storeAfter(key, data, deleted)
+		}
+		return item, err
+	}
+
+	unlock := table.lockKey(key)
+	defer unlock()
+
+	if check == nil {
+		if err := table.storeBefore(key, data, deleted); err != nil {
+			return nil, err
+		}
+		return f()
+	}
+
+	if err := check(); err != nil {
+		return nil, err
+	}
+	undo, err := table.storeBeforeUndo(key, data, deleted)
+	if err != nil {
+		return nil, err
+	}
+
+	item, err := f()
+	if err != nil {
+		undo()
+	}
+	return item, err
+}
+
+// 修改缓存前写入存储，只有WriteThrough会写入，返回存储的错误
+func (table *CacheTable) storeBefore(key interface{}, data interface{}, deleted bool) error {
+	table.RLock()
+	bs := table.store
+	table.RUnlock()
+
+	if bs == nil || bs.opts.Mode != WriteThrough {
+		return nil
+	}
+
+	if err := bs.apply(key, &pendingWrite{data: data, deleted: deleted}); err != nil {
+		return fmt.Errorf("writing key %v to store: %w", key, err)
+	}
+	return nil
+}
+
+// 同storeBefore，返回撤销写入的函数，修改缓存失败时调用
+// 写入前读取存储中原来的数据，撤销时写回，调用者需要持有key的锁
+func (table *CacheTable) storeBeforeUndo(key interface{}, data interface{}, deleted bool) (func(), error) {
+	table.RLock()
+	bs := table.store
+	table.RUnlock()
+
+	if bs == nil || bs.opts.Mode != WriteThrough {
+		return func() {}, nil
+	}
+
+	var prev interface{}
+	var found bool
+	err := bs.call(func() (err error) {
+		prev, found, err = bs.store.Load(key)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading key %v from store: %w", key, err)
+	}
+	if err := bs.apply(key, &pendingWrite{data: data, deleted: deleted}); err != nil {
+		return nil, fmt.Errorf("writing key %v to store: %w", key, err)
+	}
+
+	return func() {
+		if err := bs.apply(key, &pendingWrite{data: prev, deleted: !found}); err != nil {
+			table.reportError(fmt.Errorf("restoring key %v in store: %w", key, err))
+		}
+	}, nil
+}
+
+// 修改缓存后写入存储，只有WriteBehind会加入缓冲
+func (table *CacheTable) storeAfter(key interface{}, data interface{}, deleted bool) {
+	table.RLock()
+	bs := table.store
+	table.RUnlock()
+
+	if bs != nil && bs.opts.Mode == WriteBehind {
+		bs.write(key, data, deleted)
+	}
+}
+
+// 从存储加载，作为缓存表的加载函数
+// 还没有写入存储的数据优先
+func (bs *boundStore) load(key interface{}, args ...interface{}) (*CacheItem, error) {
+	bs.Lock()
+	p, ok := bs.pending[key]
+	if !ok {
+		p, ok = bs.flushing[key]
+	}
+	bs.Unlock()
+
+	if ok {
+		if p.deleted {
+			return nil, nil
+		}
+		return NewCacheItem(key, bs.opts.LifeSpan, p.data), nil
+	}
+
+	data, found, err := bs.store.Load(key)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return NewCacheItem(key, bs.opts.LifeSpan, data), nil
+}
+
+// WriteBehind写入或者删除，加入缓冲
+func (bs *boundStore) write(key interface{}, data interface{}, deleted bool) {
+	bs.Lock()
+	bs.pending[key] = &pendingWrite{data: data, deleted: deleted}
+	full := bs.opts.FlushSize > 0 && len(bs.pending) >= bs.opts.FlushSize
+	bs.Unlock()
+
+	if full {
+		select {
+		case bs.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// WriteBehind的写入协程
+func (bs *boundStore) run() {
+	ticker := time.NewTicker(bs.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			bs.flush()
+		case <-bs.kick:
+			bs.flush()
+		case <-bs.closing:
+			// 写入所有缓冲的数据，失败的会重新缓冲，重试次数用完为止
+			var errs []error
+			for {
+				bs.Lock()
+				n := len(bs.pending)
+				bs.Unlock()
+				if n == 0 {
+					break
+				}
+				errs = append(errs, bs.flush()...)
+			}
+			bs.done <- errors.Join(errs...)
+			return
+		}
+	}
+}
+
+// 写入所有缓冲的数据
+// 失败的重新缓冲等待下次写入，期间有新的写入则以新的为准
+// 返回重试次数用完被丢弃的错误
+func (bs *boundStore) flush() []error {
+	bs.Lock()
+	batch := bs.pending
+	bs.pending = make(map[interface{}]*pendingWrite)
+	bs.flushing = batch
+	bs.Unlock()
+
+	var dropped []error
+	for key, p := range batch {
+		err := bs.apply(key, p)
+		if err == nil {
+			continue
+		}
+
+		p.retries++
+		if p.retries > bs.opts.MaxRetries {
+			err = fmt.Errorf("writing key %v to store, dropped: %w", key, err)
+			bs.table.reportError(err)
+			dropped = append(dropped, err)
+			continue
+		}
+
+		bs.Lock()
+		if _, ok := bs.pending[key]; !ok {
+			bs.pending[key] = p
+		}
+		bs.Unlock()
+	}
+
+	bs.Lock()
+	bs.flushing = nil
+	bs.Unlock()
+
+	return dropped
+}
+
+// 写入存储，panic算作写入失败
+func (bs *boundStore) apply(key interface{}, p *pendingWrite) error {
+	return bs.call(func() error {
+		if p.deleted {
+			return bs.store.Delete(key)
+		}
+		return bs.store.Store(key, p.data)
+	})
+}
+
+// 调用存储，panic转换成ErrStorePanic交给onError
+// 保证存储的panic不会让WriteBehind的写入协程退出
+func (bs *boundStore) call(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrStorePanic, r)
+			bs.table.reportError(err)
+		}
+	}()
+
+	return f()
+}
@@ -0,0 +1,58 @@
+// 封装了对回调函数订阅的操作
+
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// 回调函数的订阅，可以单独取消，不影响其他的回调函数
+type Subscription struct {
+	once sync.Once
+	cancel func()
+}
+
+// 带有id的回调函数，通过id删除
+type callbackEntry[F any] struct {
+	id uint64
+	f F
+}
+
+// 回调函数id的计数器
+var callbackID uint64
+
+// 取消订阅，多次调用只有第一次生效
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(s.cancel)
+}
+
+// 创建订阅
+func newSubscription(cancel func()) *Subscription {
+	return &Subscription{cancel: cancel}
+}
+
+// 创建带有新id的回调函数
+func newCallbackEntry[F any](f F) callbackEntry[F] {
+	return callbackEntry[F]{atomic.AddUint64(&callbackID, 1), f}
+}
+
+// 删除id对应的回调函数，返回新的切片
+// 触发回调时使用的是切片的快照，不能原地修改
+func removeCallback[F any](entries []callbackEntry[F], id uint64) []callbackEntry[F] {
+	r := make([]callbackEntry[F], 0, len(entries))
+	for _, e := range entries {
+		if e.id != id {
+			r = append(r, e)
+		}
+	}
+
+	return r
+}
@@ -0,0 +1,164 @@
+// 封装了对缓存预热的操作
+
+/*
+ * Simple caching library with expiration capabilities
+ *     Copyright (c) 2013-2017, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package cache2go
+
+import (
+	"errors"
+	"sync"
+)
+
+// 创建缓存表时的预热选项
+type Warmer struct {
+	// 预热使用的加载函数，会设置为缓存表的加载函数
+	Loader LoaderFunc
+	// 返回需要预热的key，例如以前通过HotKeys保存下来的热点key
+	Keys func() ([]interface{}, error)
+	// 同时加载的个数，小于等于0时使用1
+	Concurrency int
+	// 每完成一个key调用一次，done是已经完成的个数，err是该key加载的错误
+	// 可能被多个协程同时调用
+	Progress func(done, total int, key interface{}, err error)
+}
+
+// 创建缓存表，新创建时设置加载函数并预热，预热完成后返回
+// 缓存表已经存在时直接返回，不会再次预热
+func CacheWithWarmer(table string, warmer Warmer) (*CacheTable, error) {
+	t, created := cacheTable(table)
+	if !created {
+		return t, nil
+	}
+
+	if warmer.Loader != nil {
+		t.SetLoader(warmer.Loader)
+	}
+
+	if warmer.Keys == nil {
+		return t, nil
+	}
+
+	keys, err := warmer.Keys()
+	if err != nil {
+		return t, err
+	}
+
+	_, err = t.warm(keys, warmer.Concurrency, warmer.Progress)
+
+	return t, err
+}
+
+// 通过加载函数预热keys，最多concurrency个key同时加载
+// 已经存在的key会跳过，返回加载到的条目个数和加载失败的错误
+// 没有加载函数的key最后一起交给批量加载函数，都没有时返回ErrNoLoader
+func (table *CacheTable) Warm(keys []interface{}, concurrency int) (int, error) {
+	return table.warm(keys, concurrency, nil)
+}
+
+// 返回访问最多的count个key，可以保存下来作为下次预热的key
+func (table *CacheTable) HotKeys(count int64) []interface{} {
+	var keys []interface{}
+	for _, item := range table.MostAccessed(count) {
+		keys = append(keys, item.key)
+	}
+
+	return keys
+}
+
+// 预热的实现
+func (table *CacheTable) warm(keys []interface{}, concurrency int, progress func(int, int, interface{}, error)) (int, error) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	table.RLock()
+	batchLoader := table.batchLoader
+	table.RUnlock()
+
+	var m sync.Mutex
+	var loaded, done int
+	var errs []error
+	// 只能批量加载的key
+	var batched []interface{}
+
+	// 记录一个key的结果
+	finish := func(key interface{}, ok bool, err error) {
+		m.Lock()
+		done++
+		n := done
+		if ok {
+			loaded++
+		}
+		// 不存在的key不算失败
+		if err != nil && err != ErrKeyNotFound && err != ErrKeyNotFoundOrLoadable {
+			errs = append(errs, err)
+		}
+		m.Unlock()
+
+		if progress != nil {
+			table.safeCall(func() { progress(n, len(keys), key, err) })
+		}
+	}
+
+	// 限制同时加载的个数
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for _, key := range keys {
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(key interface{}) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if table.Exists(key) {
+				finish(key, false, nil)
+				return
+			}
+
+			loadData, routed, err := table.loaderFor(key)
+			switch {
+			case err != nil:
+				finish(key, false, err)
+			case loadData == nil && !routed && batchLoader != nil:
+				m.Lock()
+				batched = append(batched, key)
+				m.Unlock()
+			case loadData == nil:
+				finish(key, false, ErrNoLoader)
+			default:
+				// 同一个key正在被Value等加载时等待加载的结果
+				_, err = table.loadShared(key)
+				finish(key, err == nil, err)
+			}
+		}(key)
+	}
+
+	wg.Wait()
+
+	if len(batched) > 0 {
+		items, err := table.loadBatch(batched, batchLoader)
+		for _, key := range batched {
+			_, ok := items[key]
+			var kerr error
+			if !ok {
+				if kerr = err; kerr == nil {
+					kerr = ErrKeyNotFoundOrLoadable
+				}
+			}
+			finish(key, ok, kerr)
+		}
+	}
+
+	table.log("Warmed", loaded, "of", len(keys), "items in table", table.name)
+
+	return loaded, errors.Join(errs...)
+}